@@ -20,6 +20,11 @@ func init() {
 
 // @license.name Apache 2.0
 // @license.url http://www.apache.org/licenses/LICENSE-2.0.html
+
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description JWT of a player or staff member, sent as "Bearer <token>"
 func main() {
 	log.Println("server started..........")
 	routes.ApiServer()
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+)
+
+// error codes of failures caught before reaching the service
+const (
+	codeInvalidRequest = "invalid_request"
+	codeInternal       = "internal_error"
+)
+
+// kindStatus is the HTTP status of each kind of domain error
+var kindStatus = map[repository.Kind]int{
+	repository.KindNotFound:      http.StatusNotFound,
+	repository.KindInvalid:       http.StatusBadRequest,
+	repository.KindConflict:      http.StatusConflict,
+	repository.KindUnprocessable: http.StatusUnprocessableEntity,
+	repository.KindUnavailable:   http.StatusServiceUnavailable,
+}
+
+// respondError writes err as {"error": message, "code": code} with the status of its kind.
+// Errors that aren't domain errors are a 500.
+func respondError(c *gin.Context, err error) {
+	domainErr := repository.AsError(err)
+	if domainErr == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": codeInternal})
+		return
+	}
+	status, ok := kindStatus[domainErr.Kind]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, gin.H{"error": domainErr.Error(), "code": domainErr.Code})
+}
+
+// badRequest writes a 400 for a request that fails before reaching the service
+func badRequest(c *gin.Context, message string) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": message, "code": codeInvalidRequest})
+}
+
+// invalidRequest writes a 400 for a body that failed binding or validation,
+// with the failing fields under "details" when they are known
+func invalidRequest(c *gin.Context, req interface{}, err error) {
+	fields := fieldErrors(req, err)
+	if len(fields) == 0 {
+		badRequest(c, "invalid request")
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "code": codeInvalidRequest, "details": fields})
+}
+
+// fieldErrors names the fields behind a validation error or a binding tag failure on req
+func fieldErrors(req interface{}, err error) []models.FieldError {
+	var validationErr *models.ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.Fields
+	}
+	var tagErrs validator.ValidationErrors
+	if !errors.As(err, &tagErrs) {
+		return nil
+	}
+	fields := make([]models.FieldError, len(tagErrs))
+	for i, tagErr := range tagErrs {
+		fields[i] = models.FieldError{Field: jsonName(req, tagErr.StructField()), Message: "is " + tagErr.Tag()}
+	}
+	return fields
+}
+
+// jsonName is the JSON key of a field of the struct req points to
+func jsonName(req interface{}, field string) string {
+	t := reflect.TypeOf(req)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if f, ok := t.FieldByName(field); ok {
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+			return name
+		}
+	}
+	return field
+}
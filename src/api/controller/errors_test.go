@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRespondError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"not found", repository.ErrTransactionNotFound, http.StatusNotFound, "transaction_not_found"},
+		{"invalid", repository.ErrUnknownCurrency, http.StatusBadRequest, "unsupported_currency"},
+		{"duplicate", repository.ErrTransactionConflict, http.StatusConflict, "duplicate_transaction"},
+		{"version conflict", fmt.Errorf("failed to apply transaction %w", repository.ErrVersionConflict), http.StatusConflict, "version_conflict"},
+		{"insufficient funds", repository.ErrInsufficientFunds, http.StatusUnprocessableEntity, "insufficient_funds"},
+		{"database down", &pgconn.ConnectError{}, http.StatusServiceUnavailable, "unavailable"},
+		{"unexpected", errors.New("boom"), http.StatusInternalServerError, codeInternal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			respondError(c, test.err)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			var response map[string]string
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, test.expectedCode, response["code"])
+			assert.NotEmpty(t, response["error"])
+		})
+	}
+}
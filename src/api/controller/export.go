@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/models"
+)
+
+// exportFlushEvery is how many rows are buffered before they are pushed to the client
+const exportFlushEvery = 500
+
+var exportColumns = []string{
+	"id", "transaction_id", "user_id", "currency", "state", "source_type", "amount",
+	"processed_at", "canceled", "canceled_at", "cancel_reason", "running_balance",
+}
+
+// exportWriter encodes exported rows one at a time
+type exportWriter interface {
+	ContentType() string
+	Begin() error
+	Write(row models.ExportRow) error
+	Flush() error
+}
+
+func newExportWriter(format string, w io.Writer) exportWriter {
+	if format == models.ExportNDJSON {
+		return &ndjsonExport{w: w, encoder: json.NewEncoder(w)}
+	}
+	return &csvExport{w: w, writer: csv.NewWriter(w)}
+}
+
+type csvExport struct {
+	w      io.Writer
+	writer *csv.Writer
+}
+
+func (e *csvExport) ContentType() string {
+	return "text/csv"
+}
+
+func (e *csvExport) Begin() error {
+	return e.writer.Write(exportColumns)
+}
+
+func (e *csvExport) Write(row models.ExportRow) error {
+	canceledAt := ""
+	if row.CanceledAt != nil {
+		canceledAt = row.CanceledAt.UTC().Format(time.RFC3339Nano)
+	}
+	return e.writer.Write([]string{
+		strconv.FormatUint(uint64(row.ID), 10),
+		row.TransactionID,
+		strconv.FormatUint(uint64(row.UserID), 10),
+		row.Currency,
+		row.State,
+		row.SourceType,
+		row.Amount.String(),
+		row.ProcessedAt.UTC().Format(time.RFC3339Nano),
+		strconv.FormatBool(row.Canceled),
+		canceledAt,
+		row.CancelReason,
+		row.RunningBalance.String(),
+	})
+}
+
+func (e *csvExport) Flush() error {
+	e.writer.Flush()
+	if err := e.writer.Error(); err != nil {
+		return err
+	}
+	flush(e.w)
+	return nil
+}
+
+type ndjsonExport struct {
+	w       io.Writer
+	encoder *json.Encoder
+}
+
+func (e *ndjsonExport) ContentType() string {
+	return "application/x-ndjson"
+}
+
+func (e *ndjsonExport) Begin() error {
+	return nil
+}
+
+func (e *ndjsonExport) Write(row models.ExportRow) error {
+	return e.encoder.Encode(row)
+}
+
+func (e *ndjsonExport) Flush() error {
+	flush(e.w)
+	return nil
+}
+
+// abortStream drops the connection of a response whose body is already partly sent,
+// so the client sees a broken transfer instead of a complete looking but truncated export
+func abortStream(c *gin.Context) {
+	conn, _, err := c.Writer.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+func flush(w io.Writer) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/service"
+)
+
+// page sizes for the run history
+const (
+	defaultRunsLimit = 20
+	maxRunsLimit     = 100
+)
+
+type JobControllerInterface interface {
+	GetCancellationRuns(c *gin.Context)
+	GetCancellationRun(c *gin.Context)
+}
+
+type jobController struct {
+	service service.JobServiceInterface
+}
+
+func NewJobController(ser service.JobServiceInterface) JobControllerInterface {
+	return &jobController{
+		ser,
+	}
+}
+
+// GetCancellationRuns godoc
+// @Summary List cancellation job runs
+// @Description Retrieve the most recent runs of the odd transaction cancellation job, newest first
+// @Tags jobs
+// @Produce json
+// @Param limit query int false "Number of runs to return (default 20, max 100)"
+// @Success 200 {array} models.CancellationRun
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /jobs/cancellations [get]
+func (controller jobController) GetCancellationRuns(c *gin.Context) {
+	limit := defaultRunsLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			badRequest(c, "invalid limit")
+			return
+		}
+		if n > maxRunsLimit {
+			n = maxRunsLimit
+		}
+		limit = n
+	}
+	runs, err := controller.service.GetCancellationRuns(limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// GetCancellationRun godoc
+// @Summary Get a cancellation job run
+// @Description Retrieve the candidates, canceled and skipped transactions and balance impact of one run
+// @Tags jobs
+// @Produce json
+// @Param runId path int true "Run ID"
+// @Success 200 {object} models.CancellationRun
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Run not found"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /jobs/cancellations/{runId} [get]
+func (controller jobController) GetCancellationRun(c *gin.Context) {
+	runId, err := strconv.ParseUint(c.Param("runId"), 10, 32)
+	if err != nil {
+		badRequest(c, "failed to parse the id")
+		return
+	}
+	run, err := controller.service.GetCancellationRun(uint(runId))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"run": run})
+}
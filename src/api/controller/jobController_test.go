@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockJobService struct {
+	mock.Mock
+}
+
+func (m *mockJobService) GetCancellationRuns(limit int) ([]models.CancellationRun, error) {
+	args := m.Called(limit)
+	if runs, ok := args.Get(0).([]models.CancellationRun); ok {
+		return runs, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockJobService) GetCancellationRun(runId uint) (*models.CancellationRun, error) {
+	args := m.Called(runId)
+	if run, ok := args.Get(0).(*models.CancellationRun); ok {
+		return run, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func TestJobController(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		serviceMock    func(m *mockJobService)
+		expectedError  string
+	}{
+		{
+			name: "list runs with default limit",
+			path: "/jobs/cancellations",
+			serviceMock: func(m *mockJobService) {
+				m.On("GetCancellationRuns", defaultRunsLimit).Return([]models.CancellationRun{{ID: 2}, {ID: 1}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "limit is capped",
+			path: "/jobs/cancellations?limit=1000",
+			serviceMock: func(m *mockJobService) {
+				m.On("GetCancellationRuns", maxRunsLimit).Return([]models.CancellationRun{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid limit",
+			path:           "/jobs/cancellations?limit=-1",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid limit",
+		},
+		{
+			name: "get run",
+			path: "/jobs/cancellations/7",
+			serviceMock: func(m *mockJobService) {
+				m.On("GetCancellationRun", uint(7)).Return(&models.CancellationRun{
+					ID:          7,
+					CanceledIDs: []uint{3},
+					Skipped:     []models.SkippedTransaction{{ID: 5, Reason: "balance cannot be negative"}},
+				}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "unknown run",
+			path: "/jobs/cancellations/8",
+			serviceMock: func(m *mockJobService) {
+				m.On("GetCancellationRun", uint(8)).Return(nil, repository.ErrRunNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "cancellation run not found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockJobService)
+			if test.serviceMock != nil {
+				test.serviceMock(mockService)
+			}
+			controller := jobController{
+				service: mockService,
+			}
+
+			router := gin.Default()
+			router.GET("/jobs/cancellations", controller.GetCancellationRuns)
+			router.GET("/jobs/cancellations/:runId", controller.GetCancellationRun)
+
+			req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedError != "" {
+				var response map[string]string
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Contains(t, response["error"], test.expectedError)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/service"
+)
+
+type ProviderControllerInterface interface {
+	GetProviders(c *gin.Context)
+	GetProvider(c *gin.Context)
+	CreateProvider(c *gin.Context)
+	UpdateProvider(c *gin.Context)
+	DeleteProvider(c *gin.Context)
+}
+
+type providerController struct {
+	service service.ProviderServiceInterface
+}
+
+func NewProviderController(ser service.ProviderServiceInterface) ProviderControllerInterface {
+	return &providerController{
+		ser,
+	}
+}
+
+// GetProviders godoc
+// @Summary List providers
+// @Description List the providers of the registry, the sources allowed in Source-Type. Secrets are never returned, has_secret tells whether one is set.
+// @Tags providers
+// @Produce json
+// @Success 200 {array} models.Provider
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /providers [get]
+func (controller providerController) GetProviders(c *gin.Context) {
+	providers, err := controller.service.GetProviders()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
+
+// GetProvider godoc
+// @Summary Get a provider
+// @Tags providers
+// @Produce json
+// @Param name path string true "Provider name"
+// @Success 200 {object} models.Provider
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Provider not found"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /providers/{name} [get]
+func (controller providerController) GetProvider(c *gin.Context) {
+	provider, err := controller.service.GetProvider(c.Param("name"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"provider": provider})
+}
+
+// CreateProvider godoc
+// @Summary Register a provider
+// @Description Register a provider, enabled for win and lost with the default limit unless the request says otherwise
+// @Tags providers
+// @Accept json
+// @Produce json
+// @Param provider body models.ProviderRequest true "Provider"
+// @Success 201 {object} models.Provider
+// @Failure 400 {object} map[string]interface{} "Bad Request, with the failing fields under details"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 409 {object} map[string]string "Provider already exists"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /providers [post]
+func (controller providerController) CreateProvider(c *gin.Context) {
+	req := &models.ProviderRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		badRequest(c, "invalid request")
+		return
+	}
+	provider, err := controller.service.CreateProvider(req)
+	if err != nil {
+		providerError(c, req, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"provider": provider})
+}
+
+// UpdateProvider godoc
+// @Summary Change a provider
+// @Description Change the fields the request sets. A secret rotates the credentials: the new secret becomes current and the current one stays active as the previous until retire_previous_secret.
+// @Tags providers
+// @Accept json
+// @Produce json
+// @Param name path string true "Provider name"
+// @Param provider body models.ProviderRequest true "Fields to change"
+// @Success 200 {object} models.Provider
+// @Failure 400 {object} map[string]interface{} "Bad Request, with the failing fields under details"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Provider not found"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /providers/{name} [patch]
+func (controller providerController) UpdateProvider(c *gin.Context) {
+	req := &models.ProviderRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		badRequest(c, "invalid request")
+		return
+	}
+	provider, err := controller.service.UpdateProvider(c.Param("name"), req)
+	if err != nil {
+		providerError(c, req, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"provider": provider})
+}
+
+// DeleteProvider godoc
+// @Summary Remove a provider
+// @Description Remove a provider from the registry. Its transactions are kept; disable a provider instead to keep it listed.
+// @Tags providers
+// @Param name path string true "Provider name"
+// @Success 204
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Provider not found"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /providers/{name} [delete]
+func (controller providerController) DeleteProvider(c *gin.Context) {
+	if err := controller.service.DeleteProvider(c.Param("name")); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// providerError writes a rejected provider request with its failing fields, or any other error
+func providerError(c *gin.Context, req *models.ProviderRequest, err error) {
+	if fields := fieldErrors(req, err); len(fields) > 0 {
+		invalidRequest(c, req, err)
+		return
+	}
+	respondError(c, err)
+}
@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockProviderService struct {
+	service.ProviderLookup
+	mock.Mock
+}
+
+func (m *mockProviderService) GetProviders() ([]models.Provider, error) {
+	args := m.Called()
+	if providers, ok := args.Get(0).([]models.Provider); ok {
+		return providers, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockProviderService) GetProvider(name string) (*models.Provider, error) {
+	args := m.Called(name)
+	if provider, ok := args.Get(0).(*models.Provider); ok {
+		return provider, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockProviderService) CreateProvider(req *models.ProviderRequest) (*models.Provider, error) {
+	args := m.Called(req)
+	if provider, ok := args.Get(0).(*models.Provider); ok {
+		return provider, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockProviderService) UpdateProvider(name string, req *models.ProviderRequest) (*models.Provider, error) {
+	args := m.Called(name, req)
+	if provider, ok := args.Get(0).(*models.Provider); ok {
+		return provider, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockProviderService) DeleteProvider(name string) error {
+	return m.Called(name).Error(0)
+}
+func (m *mockProviderService) Invalidate() {}
+
+func TestProviderController(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	game := models.DefaultProvider("game")
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		serviceMock    func(m *mockProviderService)
+		expectedError  string
+		expectedFields []string
+	}{
+		{
+			name:   "list providers",
+			method: http.MethodGet,
+			path:   "/providers",
+			serviceMock: func(m *mockProviderService) {
+				m.On("GetProviders").Return([]models.Provider{game}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "unknown provider",
+			method: http.MethodGet,
+			path:   "/providers/casino",
+			serviceMock: func(m *mockProviderService) {
+				m.On("GetProvider", "casino").Return(nil, repository.ErrProviderNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "provider not found",
+		},
+		{
+			name:   "register a provider",
+			method: http.MethodPost,
+			path:   "/providers",
+			body:   `{"name": "casino", "secret": "s1"}`,
+			serviceMock: func(m *mockProviderService) {
+				m.On("CreateProvider", &models.ProviderRequest{Name: "casino", Secret: "s1"}).Return(&models.Provider{Name: "casino", HasSecret: true}, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "provider already registered",
+			method: http.MethodPost,
+			path:   "/providers",
+			body:   `{"name": "game"}`,
+			serviceMock: func(m *mockProviderService) {
+				m.On("CreateProvider", mock.Anything).Return(nil, repository.ErrProviderExists)
+			},
+			expectedStatus: http.StatusConflict,
+			expectedError:  "provider already exists",
+		},
+		{
+			name:   "invalid provider",
+			method: http.MethodPost,
+			path:   "/providers",
+			body:   `{"name": "Casino 1", "allowed_states": ["draw"]}`,
+			serviceMock: func(m *mockProviderService) {
+				m.On("CreateProvider", mock.Anything).Return(nil, &models.ValidationError{Fields: []models.FieldError{
+					{Field: "name", Message: "is invalid"},
+					{Field: "allowed_states", Message: "must be win or lost"},
+				}})
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid request",
+			expectedFields: []string{"name", "allowed_states"},
+		},
+		{
+			name:           "malformed body",
+			method:         http.MethodPatch,
+			path:           "/providers/game",
+			body:           `{"enabled": "no"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid request",
+		},
+		{
+			name:   "disable a provider",
+			method: http.MethodPatch,
+			path:   "/providers/game",
+			body:   `{"enabled": false}`,
+			serviceMock: func(m *mockProviderService) {
+				m.On("UpdateProvider", "game", mock.Anything).Return(&models.Provider{Name: "game"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "remove a provider",
+			method: http.MethodDelete,
+			path:   "/providers/game",
+			serviceMock: func(m *mockProviderService) {
+				m.On("DeleteProvider", "game").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "remove an unknown provider",
+			method: http.MethodDelete,
+			path:   "/providers/casino",
+			serviceMock: func(m *mockProviderService) {
+				m.On("DeleteProvider", "casino").Return(repository.ErrProviderNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "provider not found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockProviderService)
+			if test.serviceMock != nil {
+				test.serviceMock(mockService)
+			}
+			controller := providerController{
+				service: mockService,
+			}
+
+			router := gin.Default()
+			router.GET("/providers", controller.GetProviders)
+			router.POST("/providers", controller.CreateProvider)
+			router.GET("/providers/:name", controller.GetProvider)
+			router.PATCH("/providers/:name", controller.UpdateProvider)
+			router.DELETE("/providers/:name", controller.DeleteProvider)
+
+			req, _ := http.NewRequest(test.method, test.path, bytes.NewBufferString(test.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedError != "" {
+				var response map[string]interface{}
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Contains(t, response["error"], test.expectedError)
+			}
+			if test.expectedFields != nil {
+				var response struct {
+					Details []models.FieldError `json:"details"`
+				}
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				var fields []string
+				for _, detail := range response.Details {
+					fields = append(fields, detail.Field)
+				}
+				assert.Equal(t, test.expectedFields, fields)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestProviderRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	payment := models.Provider{Name: "payment", Enabled: true, AllowedStates: []string{"win"}, MaxAmount: 500000}
+	casino := models.DefaultProvider("casino")
+	casino.Enabled = false
+	defer func(providers service.ProviderLookup) { Providers = providers }(Providers)
+	Providers = service.NewStaticProviders([]models.Provider{payment, casino})
+
+	tests := []struct {
+		name           string
+		sourceType     string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"disabled provider", "casino", `{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx_1", "userId": 1}`, http.StatusConflict, "provider_disabled"},
+		{"state not allowed", "payment", `{"state": "lost", "amount": 10, "currency": "USD", "transactionId": "tx_1", "userId": 1}`, http.StatusBadRequest, "invalid_request"},
+		{"over the provider limit", "payment", `{"state": "win", "amount": 500.001, "currency": "USD", "transactionId": "tx_1", "userId": 1}`, http.StatusBadRequest, "invalid_request"},
+		{"removed provider", "game", `{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx_1", "userId": 1}`, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller := userController{
+				service: new(mockService),
+			}
+			router := gin.Default()
+			router.POST("/transaction", controller.Create)
+
+			req, _ := http.NewRequest(http.MethodPost, "/transaction", bytes.NewBufferString(test.body))
+			req.Header.Set("Source-Type", test.sourceType)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			var response map[string]interface{}
+			_ = json.Unmarshal(w.Body.Bytes(), &response)
+			if test.expectedCode != "" {
+				assert.Equal(t, test.expectedCode, response["code"])
+			}
+		})
+	}
+}
@@ -1,23 +1,68 @@
 package controller
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
 	"github.com/myrachanto/entaingo/src/api/service"
 )
 
 // UserController ...
 var (
 	UserController UserControllerInterface = &userController{}
-	ValidSources                           = []string{"game", "server", "payment"}
+	// ValidSources are the providers the registry is seeded with on its first start
+	ValidSources = []string{"game", "server", "payment"}
+	// Providers is the registry Source-Type is checked against, the seed providers until the server sets the database registry
+	Providers = service.NewStaticProviders(DefaultProviders())
+)
+
+// DefaultProviders are the ValidSources as registry entries, enabled for win and lost
+func DefaultProviders() []models.Provider {
+	providers := make([]models.Provider, len(ValidSources))
+	for i, name := range ValidSources {
+		providers[i] = models.DefaultProvider(name)
+	}
+	return providers
+}
+
+// SignedProviderKey is where the signature check keeps the provider that signed a request
+const SignedProviderKey = "signedProvider"
+
+// sseHeartbeat is how often an idle event stream sends a comment to keep proxies from closing it
+const sseHeartbeat = 15 * time.Second
+
+// maxBatchSize caps the transactions of one batch
+const maxBatchSize = 500
+
+// page sizes for transaction listings
+const (
+	defaultTransactionsLimit = 50
+	maxTransactionsLimit     = 200
 )
 
 type UserControllerInterface interface {
 	Create(c *gin.Context)
+	CreateBatch(c *gin.Context)
 	GetTransactions(c *gin.Context)
+	ExportTransactions(c *gin.Context)
+	GetTransactionStatus(c *gin.Context)
+	CancelTransaction(c *gin.Context)
+	ReconcileUser(c *gin.Context)
+	CreateUser(c *gin.Context)
+	OpenWallet(c *gin.Context)
+	GetUser(c *gin.Context)
+	GetBalance(c *gin.Context)
+	SubscribeBalance(c *gin.Context)
+	UpdateUserStatus(c *gin.Context)
 }
 
 type userController struct {
@@ -34,76 +79,711 @@ func NewUserController(ser service.UserServiceInterface) UserControllerInterface
 
 // Create godoc
 // @Summary Create a transaction
-// @Description Create a new transaction item
+// @Description Create a new transaction item. The state must be win or lost, the amount positive and at most 1,000,000, and the transactionId at most 64 letters, digits and . _ : - characters. Retrying a transactionId with the same payload returns the stored result with an Idempotent-Replayed header; a different payload is a 409.
 // @Tags transactions
 // @Accept json
 // @Produce json
 // @Param transaction body models.TransactionRequest true "Transaction Request"
-// @Success 201 {object} models.UserInfo "Transaction created"
-// @Failure 400 {object} map[string]string "Bad Request"
+// @Param User-Id header int false "User ID, used when the body has no userId"
+// @Param Source-Type header string true "Provider: game, server or payment"
+// @Param X-Timestamp header int true "Unix seconds the request was signed at"
+// @Param X-Nonce header string true "Unique per request of the provider"
+// @Param X-Signature header string true "Hex HMAC-SHA256 of the method, path, query, User-Id, Source-Type, X-Timestamp, X-Nonce and body, one per line, with the provider's secret"
+// @Success 200 {object} models.UserInfo "Transaction created or replayed"
+// @Failure 400 {object} map[string]interface{} "Bad Request, with the failing fields under details"
+// @Failure 401 {object} map[string]string "Missing, invalid, stale or replayed signature"
+// @Failure 404 {object} map[string]string "Unknown account"
+// @Failure 409 {object} map[string]string "Account is not active or transactionId reused with a different payload"
+// @Failure 422 {object} map[string]string "No wallet in the transaction currency"
 // @Failure 500 {object} map[string]string "Internal Server Error"
 // @Router /transaction [post]
 func (controller userController) Create(c *gin.Context) {
 	transaction := &models.TransactionRequest{}
 	// Parse the request body
 	if err := c.ShouldBindJSON(&transaction); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		invalidRequest(c, transaction, err)
+		return
+	}
+	if err := transaction.Validate(); err != nil {
+		invalidRequest(c, transaction, err)
 		return
 	}
 
-	// check for source validity
-	sourceType := c.GetHeader("Source-Type")
-	ok := validSources(sourceType)
+	// the provider must be enabled and allow the transaction
+	provider, ok := sourceProvider(c)
 	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Source-Type"})
 		return
 	}
-	transaction.SourceType = sourceType
+	if err := provider.Admits(transaction); err != nil {
+		invalidRequest(c, transaction, err)
+		return
+	}
+	transaction.SourceType = provider.Name
+
+	// the account can come from the body or the User-Id header
+	if transaction.UserID == 0 {
+		userId, err := strconv.ParseUint(c.GetHeader("User-Id"), 10, 32)
+		if err != nil || userId == 0 {
+			badRequest(c, "missing or invalid user id")
+			return
+		}
+		transaction.UserID = uint(userId)
+	}
 
 	res, err := controller.service.Create(transaction)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
+		return
+	}
+
+	// a retried transactionId gets the stored result back, marked as a replay
+	if res != nil && res.Replayed {
+		c.Header("Idempotent-Replayed", "true")
+	}
+	c.JSON(http.StatusOK, gin.H{"data": res})
+}
+
+// CreateBatch godoc
+// @Summary Create a batch of transactions
+// @Description Apply up to 500 transactions of one user in order under a single lock. In atomic mode (the default) every item applies or none does and a failed batch answers 422; in best_effort mode failing items are skipped. Each item reports applied, duplicate, insufficient_funds, invalid or not_applied.
+// @Tags transactions
+// @Accept json
+// @Produce json
+// @Param transactions body []models.TransactionRequest true "Transactions, applied in order"
+// @Param mode query string false "atomic or best_effort"
+// @Param User-Id header int false "User ID, used by items without a userId"
+// @Param Source-Type header string true "Provider: game, server or payment"
+// @Param X-Timestamp header int true "Unix seconds the request was signed at"
+// @Param X-Nonce header string true "Unique per request of the provider"
+// @Param X-Signature header string true "Hex HMAC-SHA256 of the method, path, query, User-Id, Source-Type, X-Timestamp, X-Nonce and body, one per line, with the provider's secret"
+// @Success 200 {object} models.BatchResult
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing, invalid, stale or replayed signature"
+// @Failure 404 {object} map[string]string "Unknown account"
+// @Failure 409 {object} map[string]string "Account is not active"
+// @Failure 422 {object} models.BatchResult "Atomic batch rolled back"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Router /transactions/batch [post]
+func (controller userController) CreateBatch(c *gin.Context) {
+	mode := c.DefaultQuery("mode", models.BatchAtomic)
+	if mode != models.BatchAtomic && mode != models.BatchBestEffort {
+		badRequest(c, "invalid mode")
 		return
 	}
+	// items are decoded one by one so a bad item is reported rather than failing the batch
+	var raw []json.RawMessage
+	if err := c.ShouldBindJSON(&raw); err != nil {
+		badRequest(c, "invalid request")
+		return
+	}
+	if len(raw) == 0 || len(raw) > maxBatchSize {
+		badRequest(c, "a batch holds 1 to 500 transactions")
+		return
+	}
+
+	// the provider must be enabled, each item must be allowed by it
+	provider, ok := sourceProvider(c)
+	if !ok {
+		return
+	}
+
+	// the account comes from the User-Id header or else the items, and is the same for every item
+	var userId uint
+	if v := c.GetHeader("User-Id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || id == 0 {
+			badRequest(c, "missing or invalid user id")
+			return
+		}
+		userId = uint(id)
+	}
+	items := make([]models.BatchItem, len(raw))
+	for i, data := range raw {
+		item := models.BatchItem{Index: i}
+		if err := json.Unmarshal(data, &item.Request); err != nil {
+			item.Request = models.TransactionRequest{}
+			item.Invalid = err.Error()
+		} else if err := binding.Validator.ValidateStruct(&item.Request); err != nil {
+			item.Invalid = err.Error()
+		} else if err := item.Request.Validate(); err != nil {
+			item.Invalid = err.Error()
+		} else if err := provider.Admits(&item.Request); err != nil {
+			item.Invalid = err.Error()
+		}
+		if item.Invalid == "" && item.Request.UserID != 0 {
+			if userId == 0 {
+				userId = item.Request.UserID
+			} else if item.Request.UserID != userId {
+				badRequest(c, "all transactions of a batch must share one userId")
+				return
+			}
+		}
+		item.Request.SourceType = provider.Name
+		items[i] = item
+	}
+	if userId == 0 {
+		badRequest(c, "missing or invalid user id")
+		return
+	}
+	for i := range items {
+		items[i].Request.UserID = userId
+	}
 
+	res, err := controller.service.CreateBatch(userId, mode == models.BatchAtomic, items)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if !res.Committed {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"data": res})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"data": res})
 }
 
 // Get godoc
 // @Summary Get transaction details for a user
-// @Description Retrieve transactions for a specific user by ID
+// @Description Retrieve a page of a user's transactions, newest first. Pass next_cursor from the response as cursor to read the following page.
 // @Tags transactions
 // @Accept json
 // @Produce json
 // @Param id path int true "User ID"
+// @Param state query string false "win or lost"
+// @Param source_type query string false "game, server or payment"
+// @Param canceled query bool false "only canceled (true) or only active (false) transactions"
+// @Param from query string false "processed at or after, RFC 3339"
+// @Param to query string false "processed before, RFC 3339"
+// @Param limit query int false "page size, default 50, max 200"
+// @Param cursor query string false "next_cursor of the previous page"
 // @Success 200 {object} models.UserInfo
 // @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Not the caller's account"
+// @Failure 404 {object} map[string]string "Unknown account"
 // @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
 // @Router /transaction/{id} [get]
 func (controller userController) GetTransactions(c *gin.Context) {
 	id := c.Param("id")
-	Id, err := strconv.ParseInt(id, 10, 32)
+	Id, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		badRequest(c, "failed to parse the id")
+		return
+	}
+	filter, err := transactionFilter(c)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{"status": "failed to parse the id"})
+		badRequest(c, err.Error())
 		return
 	}
-	userInfo, err := controller.service.GetTransactions(int(Id))
+	filter.UserID = uint(Id)
+	userInfo, err := controller.service.GetTransactions(filter)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"msg": err.Error()})
+		respondError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"userInfo": userInfo})
 }
 
-func validSources(sourceType string) bool {
+// ExportTransactions godoc
+// @Summary Export transactions
+// @Description Stream the transactions of one user, or of every user, processed in a date range as CSV or NDJSON, oldest first. Each row carries its canceled status and the running balance of its wallet; canceled transactions leave the running balance unchanged.
+// @Tags transactions
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Param from query string true "processed at or after, RFC 3339"
+// @Param to query string true "processed before, RFC 3339"
+// @Param userId query int false "only this user, every user when omitted"
+// @Param format query string false "csv (default) or ndjson"
+// @Success 200 {array} models.ExportRow
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Not the caller's account"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /transactions/export [get]
+func (controller userController) ExportTransactions(c *gin.Context) {
+	format := c.DefaultQuery("format", models.ExportCSV)
+	if format != models.ExportCSV && format != models.ExportNDJSON {
+		badRequest(c, "invalid format")
+		return
+	}
+	filter := &models.ExportFilter{}
+	if v := c.Query("userId"); v != "" {
+		userId, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			badRequest(c, "failed to parse the id")
+			return
+		}
+		filter.UserID = uint(userId)
+	}
+	var err error
+	if filter.From, err = time.Parse(time.RFC3339, c.Query("from")); err != nil {
+		badRequest(c, "invalid from, expected RFC 3339")
+		return
+	}
+	if filter.To, err = time.Parse(time.RFC3339, c.Query("to")); err != nil {
+		badRequest(c, "invalid to, expected RFC 3339")
+		return
+	}
+	if !filter.From.Before(filter.To) {
+		badRequest(c, "from must be before to")
+		return
+	}
+
+	// the status is only sent with the first row, so a query that fails up front still gets an error response
+	export := newExportWriter(format, c.Writer)
+	started := false
+	begin := func() error {
+		started = true
+		c.Header("Content-Type", export.ContentType())
+		c.Header("Content-Disposition", `attachment; filename="transactions.`+format+`"`)
+		c.Status(http.StatusOK)
+		return export.Begin()
+	}
+	rows := 0
+	err = controller.service.ExportTransactions(c.Request.Context(), filter, func(row models.ExportRow) error {
+		if !started {
+			if err := begin(); err != nil {
+				return err
+			}
+		}
+		if err := export.Write(row); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushEvery == 0 {
+			return export.Flush()
+		}
+		return nil
+	})
+	if err == nil && !started {
+		err = begin()
+	}
+	if err != nil {
+		if !started {
+			respondError(c, err)
+			return
+		}
+		log.Println("export aborted: ", err)
+		abortStream(c)
+		return
+	}
+	if err := export.Flush(); err != nil {
+		log.Println("export aborted: ", err)
+		abortStream(c)
+	}
+}
+
+// transactionFilter reads the listing filters from the query string
+func transactionFilter(c *gin.Context) (*models.TransactionFilter, error) {
+	filter := &models.TransactionFilter{
+		State:      c.Query("state"),
+		SourceType: c.Query("source_type"),
+		Limit:      defaultTransactionsLimit,
+	}
+	if filter.State != "" && !models.ValidState(filter.State) {
+		return nil, errors.New("invalid state")
+	}
+	if filter.SourceType != "" && !validSources(filter.SourceType) {
+		return nil, errors.New("invalid source_type")
+	}
+	if v := c.Query("canceled"); v != "" {
+		canceled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("invalid canceled")
+		}
+		filter.Canceled = &canceled
+	}
+	for _, bound := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if v := c.Query(bound.name); v != "" {
+			at, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.New("invalid " + bound.name + ", expected RFC 3339")
+			}
+			*bound.dst = &at
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, errors.New("invalid limit")
+		}
+		if n > maxTransactionsLimit {
+			n = maxTransactionsLimit
+		}
+		filter.Limit = n
+	}
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := models.DecodeCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		filter.After = cursor
+	}
+	return filter, nil
+}
+
+// GetTransactionStatus godoc
+// @Summary Look a transaction up by its provider transactionId
+// @Description Status check for providers after a timeout: the stored transaction, whether it is processed or canceled, and the user it affected. Providers sign the request like their transactions and only find their own; staff send a bearer token instead
+// @Tags transactions
+// @Produce json
+// @Param transactionId path string true "Provider transaction ID"
+// @Success 200 {object} models.TransactionStatus
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Unknown transaction, or another provider's"
+// @Failure 409 {object} map[string]string "Provider is disabled"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /transactions/external/{transactionId} [get]
+func (controller userController) GetTransactionStatus(c *gin.Context) {
+	status, err := controller.service.GetTransactionStatus(c.Param("transactionId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	// a provider only finds its own transactions, staff find every one
+	if provider := c.GetString(SignedProviderKey); provider != "" && status.Transaction.SourceType != provider {
+		respondError(c, repository.ErrTransactionNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": status})
+}
+
+// CancelTransaction godoc
+// @Summary Cancel a transaction
+// @Description Reverse a transaction's effect on the wallet balance and mark it canceled with a reason code. A transaction can only be canceled once.
+// @Tags transactions
+// @Accept json
+// @Produce json
+// @Param transactionId path string true "Provider transaction ID"
+// @Param reason body models.CancelRequest true "Reason code (provider_request, duplicate, fraud or support_correction)"
+// @Success 200 {object} models.UserInfo
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Unknown transaction"
+// @Failure 409 {object} map[string]string "Already canceled"
+// @Failure 422 {object} map[string]string "Balance cannot be negative"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /transaction/{transactionId}/cancel [post]
+func (controller userController) CancelTransaction(c *gin.Context) {
+	req := &models.CancelRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		badRequest(c, "invalid request")
+		return
+	}
+	userInfo, err := controller.service.CancelTransaction(c.Param("transactionId"), req.Reason)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": userInfo})
+}
+
+// ReconcileUser godoc
+// @Summary Check a user's balances against the ledger
+// @Description Compare each cached wallet balance with the sum of its journal postings and list unbalanced journal entries
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} models.LedgerCheck
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Unknown account"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /users/{id}/ledger [get]
+func (controller userController) ReconcileUser(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		badRequest(c, "failed to parse the id")
+		return
+	}
+	check, err := controller.service.ReconcileUser(uint(userId))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ledger": check})
+}
+
+// CreateUser godoc
+// @Summary Open a user account
+// @Description Create a new active user with zero balance wallets in the requested currencies, or the default currency. Providers sign the request like their transactions; staff send a bearer token instead
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param user body models.UserRequest false "Wallet currencies"
+// @Success 201 {object} models.User
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid signature or bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 409 {object} map[string]string "Provider is disabled"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /users [post]
+func (controller userController) CreateUser(c *gin.Context) {
+	userReq := &models.UserRequest{}
+	// the body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(userReq); err != nil {
+			badRequest(c, "invalid request")
+			return
+		}
+	}
+	user, err := controller.service.CreateUser(userReq)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"user": user})
+}
+
+// OpenWallet godoc
+// @Summary Open a wallet
+// @Description Add a zero balance wallet in another currency to an active user. Providers sign the request like their transactions; staff send a bearer token instead
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param wallet body models.WalletRequest true "Wallet currency"
+// @Success 201 {object} models.Wallet
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid signature or bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Unknown account"
+// @Failure 409 {object} map[string]string "Wallet exists, account is not active or provider is disabled"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /users/{id}/wallets [post]
+func (controller userController) OpenWallet(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		badRequest(c, "failed to parse the id")
+		return
+	}
+	walletReq := &models.WalletRequest{}
+	if err := c.ShouldBindJSON(walletReq); err != nil {
+		badRequest(c, "invalid request")
+		return
+	}
+	wallet, err := controller.service.OpenWallet(uint(userId), walletReq.Currency)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"wallet": wallet})
+}
+
+// GetUser godoc
+// @Summary Get a user account
+// @Description Retrieve a user's status and wallet balances by ID
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} models.User
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Not the caller's account"
+// @Failure 404 {object} map[string]string "Unknown account"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /users/{id} [get]
+func (controller userController) GetUser(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		badRequest(c, "failed to parse the id")
+		return
+	}
+	user, err := controller.service.GetUser(uint(userId))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// GetBalance godoc
+// @Summary Get a user's balances at a point in time
+// @Description Work each wallet balance back to the given instant from the stored transactions and cancellations. Cancellations count from the time they were made.
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Param at query string false "instant, RFC 3339, defaults to now"
+// @Success 200 {object} models.BalanceAsOf
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Not the caller's account"
+// @Failure 404 {object} map[string]string "Unknown account"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /users/{id}/balance [get]
+func (controller userController) GetBalance(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		badRequest(c, "failed to parse the id")
+		return
+	}
+	at := time.Now()
+	if v := c.Query("at"); v != "" {
+		at, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			badRequest(c, "invalid at, expected RFC 3339")
+			return
+		}
+	}
+	balance, err := controller.service.BalanceAt(uint(userId), at)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"balance": balance})
+}
+
+// SubscribeBalance godoc
+// @Summary Follow a user's balance changes
+// @Description Server-Sent Events stream with a "balance" event, numbered by its id, each time one of the user's balances changes. Reconnecting clients send the last id they saw as Last-Event-ID (or lastEventId) to receive the events they missed; a "reset" event means those are gone and the balance should be reloaded.
+// @Tags users
+// @Produce text/event-stream
+// @Param id path int true "User ID"
+// @Param Last-Event-ID header int false "last event id seen, to resume"
+// @Param lastEventId query int false "last event id seen, for clients that can't set headers"
+// @Success 200 {object} models.BalanceEvent
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Not the caller's account"
+// @Failure 404 {object} map[string]string "Unknown account"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /users/{id}/events [get]
+func (controller userController) SubscribeBalance(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		badRequest(c, "failed to parse the id")
+		return
+	}
+	lastEventId := c.GetHeader("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = c.Query("lastEventId")
+	}
+	var lastSeq uint64
+	if lastEventId != "" {
+		if lastSeq, err = strconv.ParseUint(lastEventId, 10, 64); err != nil {
+			badRequest(c, "invalid Last-Event-ID")
+			return
+		}
+	}
+	sub, err := controller.service.SubscribeBalance(uint(userId), lastSeq, lastEventId != "")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	if sub.Reset {
+		fmt.Fprint(c.Writer, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range sub.Replay {
+		writeBalanceEvent(c, event)
+	}
+	c.Writer.Flush()
 
-	isValidSource := false
-	for _, source := range ValidSources {
-		if sourceType == source {
-			isValidSource = true
-			break
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				// dropped for falling behind, the client reconnects and resumes
+				return
+			}
+			writeBalanceEvent(c, event)
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+		case <-c.Request.Context().Done():
+			return
 		}
+		c.Writer.Flush()
 	}
-	return isValidSource
+}
+
+func writeBalanceEvent(c *gin.Context, event models.BalanceEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("failed to encode balance event: ", err)
+		return
+	}
+	fmt.Fprintf(c.Writer, "id: %d\nevent: balance\ndata: %s\n\n", event.Seq, data)
+}
+
+// UpdateUserStatus godoc
+// @Summary Change a user account status
+// @Description Suspend, reactivate or close a user account. Closed accounts cannot be reopened.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param status body models.UserStatusRequest true "New status (active, suspended or closed)"
+// @Success 200 {object} models.User
+// @Failure 400 {object} map[string]string "Bad Request"
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Failure 404 {object} map[string]string "Unknown account"
+// @Failure 409 {object} map[string]string "Account is closed"
+// @Failure 500 {object} map[string]string "Internal Server Error"
+// @Security BearerAuth
+// @Router /users/{id}/status [patch]
+func (controller userController) UpdateUserStatus(c *gin.Context) {
+	userId, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		badRequest(c, "failed to parse the id")
+		return
+	}
+	req := &models.UserStatusRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		badRequest(c, "invalid request")
+		return
+	}
+	user, err := controller.service.UpdateUserStatus(uint(userId), req.Status)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
 
+// validSources reports whether sourceType names a provider of the registry, enabled or not
+func validSources(sourceType string) bool {
+	_, err := Providers.Lookup(sourceType)
+	return err == nil
+}
+
+// sourceProvider looks up the provider named in Source-Type, writing the error response unless it is enabled
+func sourceProvider(c *gin.Context) (*models.Provider, bool) {
+	provider, err := Providers.Lookup(c.GetHeader("Source-Type"))
+	if errors.Is(err, repository.ErrProviderNotFound) {
+		badRequest(c, "invalid Source-Type")
+		return nil, false
+	}
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	if !provider.Enabled {
+		respondError(c, repository.ErrProviderDisabled)
+		return nil, false
+	}
+	return provider, true
 }
@@ -2,14 +2,20 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/service"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -38,13 +44,13 @@ func TestTransactionHandler(t *testing.T) {
 	}{
 		{
 			name:           "Valid JSON request",
-			inputJSON:      `{"state": "win", "amount": 100.5, "transactionId": "tx12345"}`,
+			inputJSON:      `{"state": "win", "amount": 100.5, "currency": "USD", "transactionId": "tx12345"}`,
 			expectedStatus: http.StatusOK,
 			expectedBody:   `{"message":"Transaction processed successfully"}`,
 		},
 		{
 			name:           "Invalid JSON request - missing amount",
-			inputJSON:      `{"state": "completed", "transactionId": "tx12345"}`,
+			inputJSON:      `{"state": "completed", "currency": "USD", "transactionId": "tx12345"}`,
 			expectedStatus: http.StatusBadRequest,
 			expectedBody:   `{"error":"Key: 'TransactionRequest.Amount' Error:Field validation for 'Amount' failed on the 'required' tag"}`,
 		},
@@ -52,7 +58,7 @@ func TestTransactionHandler(t *testing.T) {
 			name:           "Invalid JSON request - malformed JSON",
 			inputJSON:      `{"state": "completed", "amount": "invalid_amount", "transactionId": "tx12345"}`,
 			expectedStatus: http.StatusBadRequest,
-			expectedBody:   `{"error":"json: cannot unmarshal string into Go struct field TransactionRequest.amount of type float64"}`,
+			expectedBody:   `{"error":"invalid amount: expected a number, got string"}`,
 		},
 	}
 
@@ -109,9 +115,97 @@ func (m *mockService) Create(transactionReq *models.TransactionRequest) (*models
 	}
 	return nil, args.Error(1)
 }
-func (m *mockService) GetTransactions(transactionid int) (*models.UserInfo, error) {
-	args := m.Called(transactionid)
-	return args.Get(0).(*models.UserInfo), args.Error(1)
+func (m *mockService) CreateBatch(userId uint, atomic bool, items []models.BatchItem) (*models.BatchResult, error) {
+	args := m.Called(userId, atomic, items)
+	if result, ok := args.Get(0).(*models.BatchResult); ok {
+		return result, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) ExportTransactions(ctx context.Context, filter *models.ExportFilter, fn func(row models.ExportRow) error) error {
+	args := m.Called(filter)
+	if rows, ok := args.Get(0).([]models.ExportRow); ok {
+		for _, row := range rows {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	}
+	return args.Error(1)
+}
+func (m *mockService) GetTransactions(filter *models.TransactionFilter) (*models.UserInfo, error) {
+	args := m.Called(filter)
+	if userInfo, ok := args.Get(0).(*models.UserInfo); ok {
+		return userInfo, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) GetTransactionStatus(transactionId string) (*models.TransactionStatus, error) {
+	args := m.Called(transactionId)
+	if status, ok := args.Get(0).(*models.TransactionStatus); ok {
+		return status, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) CancelTransaction(transactionId string, reason string) (*models.UserInfo, error) {
+	args := m.Called(transactionId, reason)
+	if userInfo, ok := args.Get(0).(*models.UserInfo); ok {
+		return userInfo, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) CancelOddTransactions(ctx context.Context, wg *sync.WaitGroup, elector repository.LeaderElector) {
+	m.Called(ctx, wg, elector)
+}
+
+func (m *mockService) ReconcileUser(userId uint) (*models.LedgerCheck, error) {
+	args := m.Called(userId)
+	if check, ok := args.Get(0).(*models.LedgerCheck); ok {
+		return check, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) CreateUser(userReq *models.UserRequest) (*models.User, error) {
+	args := m.Called(userReq)
+	if user, ok := args.Get(0).(*models.User); ok {
+		return user, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) OpenWallet(userId uint, currency string) (*models.Wallet, error) {
+	args := m.Called(userId, currency)
+	if wallet, ok := args.Get(0).(*models.Wallet); ok {
+		return wallet, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) GetUser(userId uint) (*models.User, error) {
+	args := m.Called(userId)
+	if user, ok := args.Get(0).(*models.User); ok {
+		return user, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) BalanceAt(userId uint, at time.Time) (*models.BalanceAsOf, error) {
+	args := m.Called(userId, at)
+	if balance, ok := args.Get(0).(*models.BalanceAsOf); ok {
+		return balance, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) SubscribeBalance(userId uint, lastSeq uint64, resume bool) (*service.Subscription, error) {
+	args := m.Called(userId, lastSeq, resume)
+	if sub, ok := args.Get(0).(*service.Subscription); ok {
+		return sub, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockService) UpdateUserStatus(userId uint, status string) (*models.User, error) {
+	args := m.Called(userId, status)
+	if user, ok := args.Get(0).(*models.User); ok {
+		return user, args.Error(1)
+	}
+	return nil, args.Error(1)
 }
 
 func TestUserController_Create(t *testing.T) {
@@ -121,9 +215,12 @@ func TestUserController_Create(t *testing.T) {
 		name           string
 		inputBody      interface{}
 		sourceType     string
+		userIdHeader   string
 		expectedStatus int
 		serviceMock    func(m *mockService)
 		expectedError  string
+		expectedFields []string
+		expectReplay   bool
 	}{
 		{
 			name: "invalid json body",
@@ -140,36 +237,243 @@ func TestUserController_Create(t *testing.T) {
 			inputBody: models.TransactionRequest{
 				TransactionID: "tx_123",
 				Amount:        100,
+				Currency:      "USD",
 				State:         "win",
 			},
 			sourceType:     "web",
 			expectedStatus: http.StatusBadRequest,
 			expectedError:  "invalid Source-Type",
 		},
+		{
+			name: "missing user id",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_123",
+				Amount:        100,
+				Currency:      "USD",
+				State:         "win",
+			},
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "missing or invalid user id",
+		},
+		{
+			name:           "missing required fields",
+			inputBody:      `{"state": "win", "userId": 1}`,
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid request",
+			expectedFields: []string{"amount", "currency", "transactionId"},
+		},
+		{
+			name: "unknown state",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_123",
+				Amount:        100,
+				Currency:      "USD",
+				State:         "completed",
+				UserID:        1,
+			},
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid request",
+			expectedFields: []string{"state"},
+		},
+		{
+			name:           "negative amount",
+			inputBody:      `{"state": "lost", "amount": -5, "currency": "USD", "transactionId": "tx_123", "userId": 1}`,
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid request",
+			expectedFields: []string{"amount"},
+		},
+		{
+			name: "oversized amount and malformed transaction id",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx 123; drop",
+				Amount:        models.MaxTransactionAmount + 1,
+				Currency:      "USD",
+				State:         "win",
+				UserID:        1,
+			},
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid request",
+			expectedFields: []string{"amount", "transactionId"},
+		},
 		{
 			name: "valid transaction",
 			inputBody: models.TransactionRequest{
 				TransactionID: "tx_123",
 				Amount:        100,
+				Currency:      "USD",
 				State:         "win",
+				UserID:        1,
 			},
 			sourceType: "game",
 			serviceMock: func(m *mockService) {
 				m.On("Create", mock.Anything).Return(&models.Transaction{
 					TransactionID: "tx_123",
 					Amount:        100,
+					Currency:      "USD",
 					State:         "win",
 					UserID:        1,
 				}, nil)
 			},
 			expectedStatus: http.StatusOK,
 		},
+		{
+			name: "user id from header",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_124",
+				Amount:        100,
+				Currency:      "USD",
+				State:         "win",
+			},
+			sourceType:   "game",
+			userIdHeader: "2",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.MatchedBy(func(req *models.TransactionRequest) bool {
+					return req.UserID == 2
+				})).Return(&models.UserInfo{User: models.User{ID: 2}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "unknown account",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_125",
+				Amount:        100,
+				Currency:      "USD",
+				State:         "win",
+				UserID:        99,
+			},
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.Anything).Return(nil, repository.ErrUnknownAccount)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "unknown account",
+		},
+		{
+			name: "inactive account",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_126",
+				Amount:        100,
+				Currency:      "USD",
+				State:         "win",
+				UserID:        3,
+			},
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.Anything).Return(nil, repository.ErrAccountInactive)
+			},
+			expectedStatus: http.StatusConflict,
+			expectedError:  "account is not active",
+		},
+		{
+			name: "unsupported currency",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_127",
+				Amount:        100,
+				Currency:      "XYZ",
+				State:         "win",
+				UserID:        1,
+			},
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.Anything).Return(nil, repository.ErrUnknownCurrency)
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "unsupported currency",
+		},
+		{
+			name: "no wallet in currency",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_128",
+				Amount:        100,
+				Currency:      "EUR",
+				State:         "win",
+				UserID:        1,
+			},
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.Anything).Return(nil, repository.ErrNoWallet)
+			},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "no wallet",
+		},
+		{
+			name: "replayed transaction",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_123",
+				Amount:        100,
+				Currency:      "USD",
+				State:         "win",
+				UserID:        1,
+			},
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.Anything).Return(&models.UserInfo{User: models.User{ID: 1}, Replayed: true}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectReplay:   true,
+		},
+		{
+			name: "reused transaction id with different payload",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_123",
+				Amount:        200,
+				Currency:      "USD",
+				State:         "win",
+				UserID:        1,
+			},
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.Anything).Return(nil, repository.ErrTransactionConflict)
+			},
+			expectedStatus: http.StatusConflict,
+			expectedError:  "different payload",
+		},
+		{
+			name: "insufficient funds",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_124",
+				Amount:        100,
+				Currency:      "USD",
+				State:         "lost",
+				UserID:        1,
+			},
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.Anything).Return(nil, repository.ErrInsufficientFunds)
+			},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "balance cannot be negative",
+		},
+		{
+			name: "concurrent balance change",
+			inputBody: models.TransactionRequest{
+				TransactionID: "tx_125",
+				Amount:        100,
+				Currency:      "USD",
+				State:         "win",
+				UserID:        1,
+			},
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("Create", mock.Anything).Return(nil, repository.ErrVersionConflict)
+			},
+			expectedStatus: http.StatusConflict,
+			expectedError:  "version conflict",
+		},
 		{
 			name: "transaction already processed",
 			inputBody: models.TransactionRequest{
 				TransactionID: "tx_123",
 				Amount:        100,
+				Currency:      "USD",
 				State:         "win",
+				UserID:        1,
 			},
 			sourceType: "server",
 			serviceMock: func(m *mockService) {
@@ -198,10 +502,14 @@ func TestUserController_Create(t *testing.T) {
 			router := gin.Default()
 			router.POST("/transaction", controller.Create)
 
-			// Prepare request body
+			// Prepare request body, raw JSON is sent as is
 			bodyBytes, _ := json.Marshal(test.inputBody)
+			if raw, ok := test.inputBody.(string); ok && test.expectedFields != nil {
+				bodyBytes = []byte(raw)
+			}
 			req, _ := http.NewRequest(http.MethodPost, "/transaction", bytes.NewBuffer(bodyBytes))
 			req.Header.Set("Source-Type", test.sourceType)
+			req.Header.Set("User-Id", test.userIdHeader)
 			req.Header.Set("Content-Type", "application/json")
 
 			// Record the response
@@ -210,12 +518,928 @@ func TestUserController_Create(t *testing.T) {
 
 			// Assertions
 			assert.Equal(t, test.expectedStatus, w.Code)
+			assert.Equal(t, test.expectReplay, w.Header().Get("Idempotent-Replayed") == "true")
+
+			if test.expectedError != "" {
+				var response map[string]string
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Contains(t, response["error"], test.expectedError)
+			}
+			if test.expectedFields != nil {
+				var response struct {
+					Code    string              `json:"code"`
+					Details []models.FieldError `json:"details"`
+				}
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Equal(t, "invalid_request", response.Code)
+				var fields []string
+				for _, detail := range response.Details {
+					fields = append(fields, detail.Field)
+				}
+				assert.Equal(t, test.expectedFields, fields)
+			}
+		})
+	}
+}
+
+func TestUserController_Users(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		inputBody      string
+		expectedStatus int
+		serviceMock    func(m *mockService)
+		expectedError  string
+	}{
+		{
+			name:   "create user",
+			method: http.MethodPost,
+			path:   "/users",
+			serviceMock: func(m *mockService) {
+				m.On("CreateUser", &models.UserRequest{}).Return(&models.User{ID: 2, Status: models.UserStatusActive}, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:      "create user with currencies",
+			method:    http.MethodPost,
+			path:      "/users",
+			inputBody: `{"currencies": ["USD", "KES"]}`,
+			serviceMock: func(m *mockService) {
+				m.On("CreateUser", &models.UserRequest{Currencies: []string{"USD", "KES"}}).Return(&models.User{ID: 3, Status: models.UserStatusActive}, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:      "create user with unsupported currency",
+			method:    http.MethodPost,
+			path:      "/users",
+			inputBody: `{"currencies": ["XYZ"]}`,
+			serviceMock: func(m *mockService) {
+				m.On("CreateUser", mock.Anything).Return(nil, repository.ErrUnknownCurrency)
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "unsupported currency",
+		},
+		{
+			name:      "open wallet",
+			method:    http.MethodPost,
+			path:      "/users/2/wallets",
+			inputBody: `{"currency": "EUR"}`,
+			serviceMock: func(m *mockService) {
+				m.On("OpenWallet", uint(2), "EUR").Return(&models.Wallet{ID: 4, UserID: 2, Currency: "EUR"}, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:      "open existing wallet",
+			method:    http.MethodPost,
+			path:      "/users/2/wallets",
+			inputBody: `{"currency": "USD"}`,
+			serviceMock: func(m *mockService) {
+				m.On("OpenWallet", uint(2), "USD").Return(nil, repository.ErrWalletExists)
+			},
+			expectedStatus: http.StatusConflict,
+			expectedError:  "already has a wallet",
+		},
+		{
+			name:   "get user",
+			method: http.MethodGet,
+			path:   "/users/2",
+			serviceMock: func(m *mockService) {
+				m.On("GetUser", uint(2)).Return(&models.User{ID: 2, Status: models.UserStatusActive}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "get user with bad id",
+			method:         http.MethodGet,
+			path:           "/users/abc",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "failed to parse the id",
+		},
+		{
+			name:   "get unknown user",
+			method: http.MethodGet,
+			path:   "/users/99",
+			serviceMock: func(m *mockService) {
+				m.On("GetUser", uint(99)).Return(nil, repository.ErrUnknownAccount)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "unknown account",
+		},
+		{
+			name:   "balance at a point in time",
+			method: http.MethodGet,
+			path:   "/users/2/balance?at=2024-10-21T14:03:00Z",
+			serviceMock: func(m *mockService) {
+				m.On("BalanceAt", uint(2), time.Date(2024, 10, 21, 14, 3, 0, 0, time.UTC)).
+					Return(&models.BalanceAsOf{UserID: 2, Wallets: []models.WalletBalance{{Currency: "USD", Balance: 40500}}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "balance at an invalid time",
+			method:         http.MethodGet,
+			path:           "/users/2/balance?at=yesterday",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid at",
+		},
+		{
+			name:   "balance of unknown user",
+			method: http.MethodGet,
+			path:   "/users/99/balance",
+			serviceMock: func(m *mockService) {
+				m.On("BalanceAt", uint(99), mock.Anything).Return(nil, repository.ErrUnknownAccount)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "unknown account",
+		},
+		{
+			name:   "reconcile user",
+			method: http.MethodGet,
+			path:   "/users/2/ledger",
+			serviceMock: func(m *mockService) {
+				m.On("ReconcileUser", uint(2)).Return(&models.LedgerCheck{UserID: 2, Balanced: true}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "reconcile unknown user",
+			method: http.MethodGet,
+			path:   "/users/99/ledger",
+			serviceMock: func(m *mockService) {
+				m.On("ReconcileUser", uint(99)).Return(nil, repository.ErrUnknownAccount)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "unknown account",
+		},
+		{
+			name:      "suspend user",
+			method:    http.MethodPatch,
+			path:      "/users/2/status",
+			inputBody: `{"status": "suspended"}`,
+			serviceMock: func(m *mockService) {
+				m.On("UpdateUserStatus", uint(2), "suspended").Return(&models.User{ID: 2, Status: models.UserStatusSuspended}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "status missing",
+			method:         http.MethodPatch,
+			path:           "/users/2/status",
+			inputBody:      `{}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid request",
+		},
+		{
+			name:      "unknown status",
+			method:    http.MethodPatch,
+			path:      "/users/2/status",
+			inputBody: `{"status": "frozen"}`,
+			serviceMock: func(m *mockService) {
+				m.On("UpdateUserStatus", uint(2), "frozen").Return(nil, repository.ErrInvalidStatus)
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid account status",
+		},
+		{
+			name:      "reopen closed account",
+			method:    http.MethodPatch,
+			path:      "/users/2/status",
+			inputBody: `{"status": "active"}`,
+			serviceMock: func(m *mockService) {
+				m.On("UpdateUserStatus", uint(2), "active").Return(nil, repository.ErrAccountClosed)
+			},
+			expectedStatus: http.StatusConflict,
+			expectedError:  "account is closed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockService)
+			if test.serviceMock != nil {
+				test.serviceMock(mockService)
+			}
+			controller := userController{
+				service: mockService,
+			}
 
+			router := gin.Default()
+			router.POST("/users", controller.CreateUser)
+			router.GET("/users/:id", controller.GetUser)
+			router.POST("/users/:id/wallets", controller.OpenWallet)
+			router.GET("/users/:id/ledger", controller.ReconcileUser)
+			router.GET("/users/:id/balance", controller.GetBalance)
+			router.PATCH("/users/:id/status", controller.UpdateUserStatus)
+
+			req, _ := http.NewRequest(test.method, test.path, bytes.NewBufferString(test.inputBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedError != "" {
+				var response map[string]string
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Contains(t, response["error"], test.expectedError)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUserController_CancelTransaction(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		transactionId  string
+		inputBody      string
+		expectedStatus int
+		serviceMock    func(m *mockService)
+		expectedError  string
+	}{
+		{
+			name:          "cancel transaction",
+			transactionId: "tx12345",
+			inputBody:     `{"reason": "fraud"}`,
+			serviceMock: func(m *mockService) {
+				m.On("CancelTransaction", "tx12345", "fraud").Return(&models.UserInfo{
+					User:        models.User{ID: 1},
+					Transaction: []models.Transaction{{TransactionID: "tx12345", Canceled: true, CancelReason: "fraud"}},
+				}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "reason missing",
+			transactionId:  "tx12345",
+			inputBody:      `{}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid request",
+		},
+		{
+			name:          "unknown reason",
+			transactionId: "tx12345",
+			inputBody:     `{"reason": "odd_transaction_job"}`,
+			serviceMock: func(m *mockService) {
+				m.On("CancelTransaction", "tx12345", "odd_transaction_job").Return(nil, repository.ErrInvalidCancelReason)
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid cancellation reason",
+		},
+		{
+			name:          "unknown transaction",
+			transactionId: "tx404",
+			inputBody:     `{"reason": "duplicate"}`,
+			serviceMock: func(m *mockService) {
+				m.On("CancelTransaction", "tx404", "duplicate").Return(nil, repository.ErrTransactionNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "transaction not found",
+		},
+		{
+			name:          "second cancel",
+			transactionId: "tx12345",
+			inputBody:     `{"reason": "duplicate"}`,
+			serviceMock: func(m *mockService) {
+				m.On("CancelTransaction", "tx12345", "duplicate").Return(nil, repository.ErrAlreadyCanceled)
+			},
+			expectedStatus: http.StatusConflict,
+			expectedError:  "already canceled",
+		},
+		{
+			name:          "reversal overdraws the wallet",
+			transactionId: "tx12345",
+			inputBody:     `{"reason": "support_correction"}`,
+			serviceMock: func(m *mockService) {
+				m.On("CancelTransaction", "tx12345", "support_correction").Return(nil, repository.ErrInsufficientFunds)
+			},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "balance cannot be negative",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockService)
+			if test.serviceMock != nil {
+				test.serviceMock(mockService)
+			}
+			controller := userController{
+				service: mockService,
+			}
+
+			router := gin.Default()
+			router.POST("/transaction/:transactionId/cancel", controller.CancelTransaction)
+
+			req, _ := http.NewRequest(http.MethodPost, "/transaction/"+test.transactionId+"/cancel", bytes.NewBufferString(test.inputBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedError != "" {
+				var response map[string]string
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Contains(t, response["error"], test.expectedError)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUserController_GetTransactions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	canceled := false
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	after := models.Cursor{ProcessedAt: time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC), ID: 7}
+
+	tests := []struct {
+		name           string
+		id             string
+		query          string
+		expectedStatus int
+		serviceMock    func(m *mockService)
+		expectedError  string
+	}{
+		{
+			name:  "first page with defaults",
+			query: "",
+			serviceMock: func(m *mockService) {
+				m.On("GetTransactions", &models.TransactionFilter{UserID: 1, Limit: defaultTransactionsLimit}).
+					Return(&models.UserInfo{User: models.User{ID: 1}, NextCursor: after.Encode()}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:  "filters and cursor",
+			query: "?state=win&source_type=game&canceled=false&from=2024-05-01T00:00:00Z&limit=10&cursor=" + after.Encode(),
+			serviceMock: func(m *mockService) {
+				m.On("GetTransactions", &models.TransactionFilter{
+					UserID:     1,
+					State:      "win",
+					SourceType: "game",
+					Canceled:   &canceled,
+					From:       &from,
+					Limit:      10,
+					After:      &after,
+				}).Return(&models.UserInfo{User: models.User{ID: 1}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:  "limit is capped",
+			query: "?limit=5000",
+			serviceMock: func(m *mockService) {
+				m.On("GetTransactions", &models.TransactionFilter{UserID: 1, Limit: maxTransactionsLimit}).
+					Return(&models.UserInfo{User: models.User{ID: 1}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "bad user id",
+			id:             "abc",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "failed to parse the id",
+		},
+		{
+			name:           "invalid state",
+			query:          "?state=pending",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid state",
+		},
+		{
+			name:           "invalid source type",
+			query:          "?source_type=casino",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid source_type",
+		},
+		{
+			name:           "invalid time range",
+			query:          "?to=yesterday",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid to",
+		},
+		{
+			name:           "invalid cursor",
+			query:          "?cursor=bogus",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid cursor",
+		},
+		{
+			name:  "unknown user",
+			query: "",
+			serviceMock: func(m *mockService) {
+				m.On("GetTransactions", mock.Anything).Return(nil, repository.ErrUnknownAccount)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "unknown account",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockService)
+			if test.serviceMock != nil {
+				test.serviceMock(mockService)
+			}
+			controller := userController{
+				service: mockService,
+			}
+
+			router := gin.Default()
+			router.GET("/transaction/:id", controller.GetTransactions)
+
+			id := test.id
+			if id == "" {
+				id = "1"
+			}
+			req, _ := http.NewRequest(http.MethodGet, "/transaction/"+id+test.query, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedError != "" {
+				var response map[string]string
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Contains(t, response["error"], test.expectedError)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUserController_GetTransactionStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		transactionId  string
+		signedBy       string // the provider that signed the request, none for staff
+		expectedStatus int
+		serviceMock    func(m *mockService)
+		expectedError  string
+		expectedState  string
+	}{
+		{
+			name:          "canceled transaction",
+			transactionId: "tx12345",
+			serviceMock: func(m *mockService) {
+				m.On("GetTransactionStatus", "tx12345").Return(&models.TransactionStatus{
+					Transaction: models.Transaction{TransactionID: "tx12345", UserID: 1, SourceType: "game", Canceled: true},
+					Status:      models.TransactionStatusCanceled,
+					User:        models.User{ID: 1},
+				}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedState:  models.TransactionStatusCanceled,
+		},
+		{
+			name:          "the provider's own transaction",
+			transactionId: "tx12345",
+			signedBy:      "game",
+			serviceMock: func(m *mockService) {
+				m.On("GetTransactionStatus", "tx12345").Return(&models.TransactionStatus{
+					Transaction: models.Transaction{TransactionID: "tx12345", UserID: 1, SourceType: "game"},
+					Status:      models.TransactionStatusProcessed,
+					User:        models.User{ID: 1},
+				}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedState:  models.TransactionStatusProcessed,
+		},
+		{
+			name:          "another provider's transaction",
+			transactionId: "tx12345",
+			signedBy:      "server",
+			serviceMock: func(m *mockService) {
+				m.On("GetTransactionStatus", "tx12345").Return(&models.TransactionStatus{
+					Transaction: models.Transaction{TransactionID: "tx12345", UserID: 1, SourceType: "game"},
+					Status:      models.TransactionStatusProcessed,
+					User:        models.User{ID: 1, Wallets: []models.Wallet{{Currency: "USD", Balance: 10000}}},
+				}, nil)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "transaction not found",
+		},
+		{
+			name:          "unknown transaction",
+			transactionId: "tx404",
+			serviceMock: func(m *mockService) {
+				m.On("GetTransactionStatus", "tx404").Return(nil, repository.ErrTransactionNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "transaction not found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockService)
+			test.serviceMock(mockService)
+			controller := userController{
+				service: mockService,
+			}
+
+			router := gin.Default()
+			router.GET("/transactions/external/:transactionId", func(c *gin.Context) {
+				if test.signedBy != "" {
+					c.Set(SignedProviderKey, test.signedBy)
+				}
+			}, controller.GetTransactionStatus)
+
+			req, _ := http.NewRequest(http.MethodGet, "/transactions/external/"+test.transactionId, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			var response struct {
+				Data  models.TransactionStatus `json:"data"`
+				Error string                   `json:"error"`
+			}
+			_ = json.Unmarshal(w.Body.Bytes(), &response)
+			assert.Contains(t, response.Error, test.expectedError)
+			assert.Equal(t, test.expectedState, response.Data.Status)
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUserController_CreateBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	valid := models.TransactionRequest{State: "win", Amount: 10000, Currency: "USD", TransactionID: "tx1", UserID: 1, SourceType: "game"}
+
+	tests := []struct {
+		name           string
+		query          string
+		inputBody      string
+		sourceType     string
+		userIdHeader   string
+		expectedStatus int
+		serviceMock    func(m *mockService)
+		expectedError  string
+	}{
+		{
+			name:         "best effort batch reports invalid items",
+			query:        "?mode=best_effort",
+			inputBody:    `[{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx1"}, {"state": "lost", "currency": "USD", "transactionId": "tx2"}]`,
+			sourceType:   "game",
+			userIdHeader: "1",
+			serviceMock: func(m *mockService) {
+				m.On("CreateBatch", uint(1), false, mock.MatchedBy(func(items []models.BatchItem) bool {
+					return len(items) == 2 &&
+						items[0].Invalid == "" && items[0].Request == valid &&
+						items[1].Index == 1 && items[1].Invalid != "" && items[1].Request.UserID == 1
+				})).Return(&models.BatchResult{Mode: models.BatchBestEffort, Committed: true}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:         "items failing validation are invalid",
+			query:        "?mode=best_effort",
+			inputBody:    `[{"state": "completed", "amount": 10, "currency": "USD", "transactionId": "tx1"}, {"state": "win", "amount": 0.5, "currency": "USD", "transactionId": "tx 2"}]`,
+			sourceType:   "game",
+			userIdHeader: "1",
+			serviceMock: func(m *mockService) {
+				m.On("CreateBatch", uint(1), false, mock.MatchedBy(func(items []models.BatchItem) bool {
+					return len(items) == 2 &&
+						strings.Contains(items[0].Invalid, "state must be win or lost") &&
+						strings.Contains(items[1].Invalid, "transactionId")
+				})).Return(&models.BatchResult{Mode: models.BatchBestEffort, Committed: true}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:       "atomic batch rolled back",
+			inputBody:  `[{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx1", "userId": 1}]`,
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("CreateBatch", uint(1), true, []models.BatchItem{{Index: 0, Request: valid}}).
+					Return(&models.BatchResult{Mode: models.BatchAtomic, Committed: false}, nil)
+			},
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "items of different users",
+			inputBody:      `[{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx1", "userId": 1}, {"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx2", "userId": 2}]`,
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "share one userId",
+		},
+		{
+			name:           "missing user",
+			inputBody:      `[{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx1"}]`,
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "missing or invalid user id",
+		},
+		{
+			name:           "invalid mode",
+			query:          "?mode=some",
+			inputBody:      `[]`,
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid mode",
+		},
+		{
+			name:           "empty batch",
+			inputBody:      `[]`,
+			sourceType:     "game",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "1 to 500",
+		},
+		{
+			name:           "invalid source type",
+			inputBody:      `[{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx1", "userId": 1}]`,
+			sourceType:     "casino",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid Source-Type",
+		},
+		{
+			name:       "unknown account",
+			inputBody:  `[{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx1", "userId": 9}]`,
+			sourceType: "game",
+			serviceMock: func(m *mockService) {
+				m.On("CreateBatch", uint(9), true, mock.Anything).Return(nil, repository.ErrUnknownAccount)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "unknown account",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockService)
+			if test.serviceMock != nil {
+				test.serviceMock(mockService)
+			}
+			controller := userController{
+				service: mockService,
+			}
+
+			router := gin.Default()
+			router.POST("/transactions/batch", controller.CreateBatch)
+
+			req, _ := http.NewRequest(http.MethodPost, "/transactions/batch"+test.query, bytes.NewBufferString(test.inputBody))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Source-Type", test.sourceType)
+			if test.userIdHeader != "" {
+				req.Header.Set("User-Id", test.userIdHeader)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedError != "" {
+				var response map[string]string
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Contains(t, response["error"], test.expectedError)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUserController_ExportTransactions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	from := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	canceledAt := time.Date(2024, 10, 3, 8, 0, 0, 0, time.UTC)
+	rows := []models.ExportRow{
+		{
+			Transaction:    models.Transaction{ID: 1, TransactionID: "tx1", UserID: 1, Currency: "USD", State: "win", SourceType: "game", Amount: 30500, ProcessedAt: time.Date(2024, 10, 2, 9, 0, 0, 0, time.UTC)},
+			RunningBalance: 130500,
+		},
+		{
+			Transaction:    models.Transaction{ID: 2, TransactionID: "tx2", UserID: 1, Currency: "USD", State: "lost", SourceType: "game", Amount: 10000, ProcessedAt: time.Date(2024, 10, 2, 10, 0, 0, 0, time.UTC), Canceled: true, CanceledAt: &canceledAt, CancelReason: "fraud"},
+			RunningBalance: 130500,
+		},
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		serviceMock    func(m *mockService)
+		expectedType   string
+		expectedBody   string
+		expectedError  string
+	}{
+		{
+			name:  "csv for one user",
+			query: "?userId=1&from=2024-10-01T00:00:00Z&to=2024-11-01T00:00:00Z",
+			serviceMock: func(m *mockService) {
+				m.On("ExportTransactions", &models.ExportFilter{UserID: 1, From: from, To: to}).Return(rows, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedType:   "text/csv",
+			expectedBody: "id,transaction_id,user_id,currency,state,source_type,amount,processed_at,canceled,canceled_at,cancel_reason,running_balance\n" +
+				"1,tx1,1,USD,win,game,30.500,2024-10-02T09:00:00Z,false,,,130.500\n" +
+				"2,tx2,1,USD,lost,game,10.000,2024-10-02T10:00:00Z,true,2024-10-03T08:00:00Z,fraud,130.500\n",
+		},
+		{
+			name:  "ndjson for every user",
+			query: "?format=ndjson&from=2024-10-01T00:00:00Z&to=2024-11-01T00:00:00Z",
+			serviceMock: func(m *mockService) {
+				m.On("ExportTransactions", &models.ExportFilter{From: from, To: to}).Return(rows[:1], nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedType:   "application/x-ndjson",
+			expectedBody:   `{"id":1,"transaction_id":"tx1","amount":30.5,"currency":"USD","state":"win","source_type":"game","user_id":1,"processed_at":"2024-10-02T09:00:00Z","canceled":false,"running_balance":130.5}` + "\n",
+		},
+		{
+			name:  "empty csv keeps its header",
+			query: "?from=2024-10-01T00:00:00Z&to=2024-11-01T00:00:00Z",
+			serviceMock: func(m *mockService) {
+				m.On("ExportTransactions", mock.Anything).Return(nil, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedType:   "text/csv",
+			expectedBody:   "id,transaction_id,user_id,currency,state,source_type,amount,processed_at,canceled,canceled_at,cancel_reason,running_balance\n",
+		},
+		{
+			name:  "failure before the first row",
+			query: "?from=2024-10-01T00:00:00Z&to=2024-11-01T00:00:00Z",
+			serviceMock: func(m *mockService) {
+				m.On("ExportTransactions", mock.Anything).Return(nil, repository.ErrUnavailable)
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedError:  "unavailable",
+		},
+		{
+			name:           "missing range",
+			query:          "?userId=1",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid from",
+		},
+		{
+			name:           "reversed range",
+			query:          "?from=2024-11-01T00:00:00Z&to=2024-10-01T00:00:00Z",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "from must be before to",
+		},
+		{
+			name:           "unknown format",
+			query:          "?format=xlsx&from=2024-10-01T00:00:00Z&to=2024-11-01T00:00:00Z",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid format",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockService)
+			if test.serviceMock != nil {
+				test.serviceMock(mockService)
+			}
+			controller := userController{
+				service: mockService,
+			}
+
+			router := gin.Default()
+			router.GET("/transactions/export", controller.ExportTransactions)
+
+			req, _ := http.NewRequest(http.MethodGet, "/transactions/export"+test.query, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedType != "" {
+				assert.Equal(t, test.expectedType, w.Header().Get("Content-Type"))
+				assert.Equal(t, test.expectedBody, w.Body.String())
+			}
+			if test.expectedError != "" {
+				var response map[string]string
+				_ = json.Unmarshal(w.Body.Bytes(), &response)
+				assert.Contains(t, response["error"], test.expectedError)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUserController_SubscribeBalance(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	event := func(amount models.Money) models.BalanceEvent {
+		return models.BalanceEvent{
+			Kind:        models.BalanceEventTransaction,
+			UserID:      1,
+			Currency:    "USD",
+			Balance:     amount,
+			Transaction: models.Transaction{ID: uint(amount), UserID: 1, Currency: "USD"},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		lastEventId    string
+		query          string
+		expectedStatus int
+		serviceMock    func(m *mockService)
+		expectedEvents []string
+		expectedError  string
+	}{
+		{
+			name: "live events",
+			serviceMock: func(m *mockService) {
+				journal := service.NewMemoryEvents()
+				broker := service.NewBalanceBroker(journal, 10)
+				sub, _ := broker.Subscribe(1, 0, false)
+				journal.Append(event(1000))
+				_ = broker.Poll()
+				// the stream ends once the buffered event is sent, as if the subscriber was dropped
+				sub.Close()
+				m.On("SubscribeBalance", uint(1), uint64(0), false).Return(sub, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedEvents: []string{"id: 1\nevent: balance\n"},
+		},
+		{
+			name:        "resume from Last-Event-ID",
+			lastEventId: "1",
+			serviceMock: func(m *mockService) {
+				journal := service.NewMemoryEvents()
+				journal.Append(event(1000))
+				journal.Append(event(2000))
+				journal.Append(event(3000))
+				sub, _ := service.NewBalanceBroker(journal, 10).Subscribe(1, 1, true)
+				sub.Close()
+				m.On("SubscribeBalance", uint(1), uint64(1), true).Return(sub, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedEvents: []string{"id: 2\nevent: balance\n", "id: 3\nevent: balance\n"},
+		},
+		{
+			name:  "resume unknown event",
+			query: "?lastEventId=99",
+			serviceMock: func(m *mockService) {
+				sub, _ := service.NewBalanceBroker(service.NewMemoryEvents(), 10).Subscribe(1, 99, true)
+				sub.Close()
+				m.On("SubscribeBalance", uint(1), uint64(99), true).Return(sub, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedEvents: []string{"event: reset\n"},
+		},
+		{
+			name:           "invalid Last-Event-ID",
+			lastEventId:    "abc",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid Last-Event-ID",
+		},
+		{
+			name: "unknown user",
+			serviceMock: func(m *mockService) {
+				m.On("SubscribeBalance", uint(1), uint64(0), false).Return(nil, repository.ErrUnknownAccount)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "unknown account",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockService := new(mockService)
+			if test.serviceMock != nil {
+				test.serviceMock(mockService)
+			}
+			controller := userController{
+				service: mockService,
+			}
+
+			router := gin.Default()
+			router.GET("/users/:id/events", controller.SubscribeBalance)
+
+			req, _ := http.NewRequest(http.MethodGet, "/users/1/events"+test.query, nil)
+			if test.lastEventId != "" {
+				req.Header.Set("Last-Event-ID", test.lastEventId)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			for _, expected := range test.expectedEvents {
+				assert.Contains(t, w.Body.String(), expected)
+			}
+			if test.expectedEvents != nil {
+				assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+				assert.Equal(t, len(test.expectedEvents), bytes.Count(w.Body.Bytes(), []byte("event: ")))
+			}
 			if test.expectedError != "" {
 				var response map[string]string
 				_ = json.Unmarshal(w.Body.Bytes(), &response)
 				assert.Contains(t, response["error"], test.expectedError)
 			}
+			mockService.AssertExpectations(t)
 		})
 	}
 }
@@ -0,0 +1,41 @@
+package models
+
+// batch modes
+const (
+	BatchAtomic     = "atomic"      // every item applies or none does
+	BatchBestEffort = "best_effort" // items apply one by one and failures are skipped
+)
+
+// batch item statuses
+const (
+	BatchItemApplied           = "applied"
+	BatchItemDuplicate         = "duplicate" // transactionId already stored with the same payload
+	BatchItemInsufficientFunds = "insufficient_funds"
+	BatchItemInvalid           = "invalid"
+	BatchItemNotApplied        = "not_applied" // rolled back with the rest of a failed atomic batch
+)
+
+// BatchItem is one transaction of a batch at its position in the request.
+// Invalid holds why the item was refused before reaching the database, if it was.
+type BatchItem struct {
+	Index   int
+	Request TransactionRequest
+	Invalid string
+}
+
+// BatchItemResult reports what happened to one item of a batch
+type BatchItemResult struct {
+	Index         int          `json:"index"`
+	TransactionID string       `json:"transactionId,omitempty"`
+	Status        string       `json:"status"`
+	Error         string       `json:"error,omitempty"`
+	Transaction   *Transaction `json:"transaction,omitempty"`
+}
+
+// BatchResult is the outcome of a batch; Committed is false when an atomic batch was rolled back
+type BatchResult struct {
+	Mode      string            `json:"mode"`
+	Committed bool              `json:"committed"`
+	User      User              `json:"user"`
+	Items     []BatchItemResult `json:"items"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import "strings"
+
+// Currencies maps the supported ISO 4217 codes to the decimal places their minor unit allows
+var Currencies = map[string]int{
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"KES": 2,
+	"UGX": 0,
+	"JPY": 0,
+	"KWD": 3,
+	"BHD": 3,
+}
+
+// NormalizeCurrency upper-cases and trims a currency code
+func NormalizeCurrency(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ValidCurrency reports whether code is a supported currency
+func ValidCurrency(code string) bool {
+	_, ok := Currencies[code]
+	return ok
+}
+
+// FitsCurrency reports whether the amount has no more decimal places than the currency allows
+func (m Money) FitsCurrency(code string) bool {
+	places, ok := Currencies[code]
+	if !ok {
+		return false
+	}
+	step := int64(1)
+	for i := places; i < MoneyScale; i++ {
+		step *= 10
+	}
+	return int64(m)%step == 0
+}
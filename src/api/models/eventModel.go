@@ -0,0 +1,19 @@
+package models
+
+// balance event kinds
+const (
+	BalanceEventTransaction  = "transaction"  // a new transaction moved the balance
+	BalanceEventCancellation = "cancellation" // a canceled transaction was reversed
+)
+
+// BalanceEvent reports a change of one of a user's wallet balances.
+// Seq is the id of the journal entry behind the event: it grows with every change, across users,
+// so clients can resume after the last one they saw.
+type BalanceEvent struct {
+	Seq         uint64      `json:"seq"`
+	Kind        string      `json:"kind"`
+	UserID      uint        `json:"user_id"`
+	Currency    string      `json:"currency"`
+	Balance     Money       `json:"balance" swaggertype:"number"`
+	Transaction Transaction `json:"transaction"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// ExportFilter selects the transactions of an export, From inclusive and To exclusive.
+// UserID 0 exports every user.
+type ExportFilter struct {
+	UserID uint
+	From   time.Time
+	To     time.Time
+}
+
+// ExportRow is one exported transaction with the balance of its wallet right after it.
+// Canceled transactions are listed but leave the running balance unchanged,
+// so the last row of a wallet matches its current balance.
+type ExportRow struct {
+	Transaction
+	RunningBalance Money `json:"running_balance" swaggertype:"number"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// CancellationRun records one tick of the odd transaction cancellation job
+type CancellationRun struct {
+	ID           uint                 `gorm:"primaryKey" json:"id"`
+	StartedAt    time.Time            `gorm:"not null;index" json:"started_at"`
+	FinishedAt   time.Time            `gorm:"not null" json:"finished_at"`
+	CandidateIDs []uint               `gorm:"serializer:json;type:jsonb" json:"candidate_ids"`
+	CanceledIDs  []uint               `gorm:"serializer:json;type:jsonb" json:"canceled_ids"`
+	Skipped      []SkippedTransaction `gorm:"serializer:json;type:jsonb" json:"skipped"`
+	Impact       []BalanceImpact      `gorm:"serializer:json;type:jsonb" json:"impact"`
+	Error        string               `gorm:"type:text" json:"error,omitempty"` // why the run stopped early, if it did
+}
+
+// BalanceImpact is the net balance change a run made to one user's wallet
+type BalanceImpact struct {
+	UserID   uint   `json:"user_id"`
+	Currency string `json:"currency"`
+	Amount   Money  `json:"amount" swaggertype:"number"`
+}
+
+// JobLease marks which replica leads a job until the lease expires
+type JobLease struct {
+	Name      string    `gorm:"primaryKey;type:varchar(100)" json:"name"`
+	Holder    string    `gorm:"type:varchar(255);not null" json:"holder"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// journal entry kinds
+const (
+	EntryWin     = "win"
+	EntryLost    = "lost"
+	EntryCancel  = "cancel"
+	EntryOpening = "opening" // balances carried over from before the ledger existed
+)
+
+// JournalEntry records one balance change as postings that sum to zero.
+// Wallet balances are a cache of their postings and can be checked against them.
+type JournalEntry struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	TransactionID *uint     `gorm:"index" json:"transaction_id"` // the transactions row behind the entry, nil for opening balances
+	Kind          string    `gorm:"type:varchar(20);not null" json:"kind"`
+	CreatedAt     time.Time `gorm:"autoCreateTime" json:"created_at"`
+	Postings      []Posting `gorm:"foreignKey:EntryID" json:"postings"`
+}
+
+// Posting is one side of a journal entry. Amounts are signed:
+// positive credits the account and negative debits it.
+type Posting struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	EntryID  uint   `gorm:"not null;index" json:"entry_id"`
+	Account  string `gorm:"type:varchar(64);not null;index" json:"account"`
+	Currency string `gorm:"type:varchar(3);not null" json:"currency"`
+	Amount   Money  `gorm:"type:decimal(20,3);not null" json:"amount" swaggertype:"number"`
+	// BalanceAfter is the wallet balance the posting left, on wallet postings only
+	BalanceAfter *Money    `gorm:"type:decimal(20,3)" json:"balance_after,omitempty" swaggertype:"number"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// WalletAccount is the ledger account of a user's wallet
+func WalletAccount(walletId uint) string {
+	return fmt.Sprintf("wallet:%d", walletId)
+}
+
+// HouseAccount is the ledger account the house settles a currency against
+func HouseAccount(currency string) string {
+	return "house:" + currency
+}
+
+// WalletCheck compares a wallet's cached balance with the sum of its postings
+type WalletCheck struct {
+	WalletID      uint   `json:"wallet_id"`
+	Currency      string `json:"currency"`
+	Balance       Money  `json:"balance" swaggertype:"number"`
+	LedgerBalance Money  `json:"ledger_balance" swaggertype:"number"`
+	Balanced      bool   `json:"balanced"`
+}
+
+// LedgerCheck is the result of reconciling a user's wallets against the journal
+type LedgerCheck struct {
+	UserID            uint          `json:"user_id"`
+	Wallets           []WalletCheck `json:"wallets"`
+	UnbalancedEntries []uint        `json:"unbalanced_entries"`
+	Balanced          bool          `json:"balanced"`
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// MoneyScale is the number of decimal places an amount may carry,
+// the finest minor unit among the supported currencies
+const MoneyScale = 3
+
+var moneyFactor = new(big.Int).Exp(big.NewInt(10), big.NewInt(MoneyScale), nil)
+
+// Money is an exact amount held as an integer number of thousandths,
+// so balance arithmetic never drifts the way float64 does.
+// It reads and writes JSON as a plain number and is stored as a numeric column.
+type Money int64
+
+// ParseMoney converts a decimal string such as "30.5" into Money.
+// Amounts with more than MoneyScale decimal places are rejected rather than rounded.
+func ParseMoney(s string) (Money, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt(moneyFactor))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("amount %s has more than %d decimal places", s, MoneyScale)
+	}
+	minor := r.Num()
+	if !minor.IsInt64() {
+		return 0, fmt.Errorf("amount %s is out of range", s)
+	}
+	return Money(minor.Int64()), nil
+}
+
+// String formats the amount with exactly MoneyScale decimal places
+func (m Money) String() string {
+	sign := ""
+	minor := int64(m)
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	factor := moneyFactor.Int64()
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/factor, MoneyScale, minor%factor)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	s := m.String()
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "" || s == "-" {
+		s = "0"
+	}
+	return []byte(s), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	raw := string(data)
+	if raw == "null" {
+		return nil
+	}
+	if raw == "" || !(raw[0] == '-' || (raw[0] >= '0' && raw[0] <= '9')) {
+		return fmt.Errorf("invalid amount: expected a number, got %s", jsonKind(raw))
+	}
+	parsed, err := ParseMoney(raw)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value stores the amount as a decimal string so the numeric column stays exact
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case int64:
+		*m = Money(v * moneyFactor.Int64())
+		return nil
+	case float64:
+		return m.scanString(strconv.FormatFloat(v, 'f', -1, 64))
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	}
+	return fmt.Errorf("cannot scan %T into Money", src)
+}
+
+func (m *Money) scanString(s string) error {
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func jsonKind(raw string) string {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return "string"
+	case raw == "true" || raw == "false":
+		return "bool"
+	case strings.HasPrefix(raw, "{"):
+		return "object"
+	case strings.HasPrefix(raw, "["):
+		return "array"
+	}
+	return raw
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Money
+		wantErr bool
+	}{
+		{"whole amount", "30", 30000, false},
+		{"one decimal", "30.5", 30500, false},
+		{"two decimals", "0.01", 10, false},
+		{"three decimals", "0.125", 125, false},
+		{"trailing zeros", "1.5000", 1500, false},
+		{"exponent", "1e2", 100000, false},
+		{"negative", "-2.25", -2250, false},
+		{"too precise", "0.0001", 0, true},
+		{"not a number", "abc", 0, true},
+		{"out of range", "1e30", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMoney(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMoneyNoDrift(t *testing.T) {
+	a, _ := ParseMoney("0.1")
+	b, _ := ParseMoney("0.2")
+	assert.Equal(t, "0.300", (a + b).String())
+}
+
+func TestMoneyFitsCurrency(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     bool
+	}{
+		{"10.25", "USD", true},
+		{"10.125", "USD", false},
+		{"10.125", "KWD", true},
+		{"100", "JPY", true},
+		{"100.5", "JPY", false},
+		{"10", "XYZ", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.amount+" "+tt.currency, func(t *testing.T) {
+			m, err := ParseMoney(tt.amount)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, m.FitsCurrency(tt.currency))
+		})
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var req TransactionRequest
+	err := json.Unmarshal([]byte(`{"amount": 100.5}`), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, Money(100500), req.Amount)
+
+	out, err := json.Marshal(Wallet{Balance: 70500})
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `"balance":70.5`)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": "100"}`), &req))
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": 1.0005}`), &req))
+}
+
+func TestMoneyScan(t *testing.T) {
+	var m Money
+	assert.NoError(t, m.Scan([]byte("70.50")))
+	assert.Equal(t, Money(70500), m)
+	assert.NoError(t, m.Scan(int64(3)))
+	assert.Equal(t, Money(3000), m)
+
+	v, err := Money(-5).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "-0.005", v)
+}
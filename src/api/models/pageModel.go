@@ -0,0 +1,64 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is a page cursor that wasn't issued by the server
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TransactionFilter narrows a user's transaction listing.
+// Empty fields don't filter; From is inclusive and To exclusive.
+type TransactionFilter struct {
+	UserID     uint
+	State      string
+	SourceType string
+	Canceled   *bool
+	From       *time.Time
+	To         *time.Time
+	Limit      int
+	After      *Cursor // continue after this row, nil for the first page
+}
+
+// Cursor is the position of the last row of a page in the (processed_at desc, id desc) order
+type Cursor struct {
+	ProcessedAt time.Time
+	ID          uint
+}
+
+// CursorAfter points past the given transaction
+func CursorAfter(transaction Transaction) Cursor {
+	return Cursor{ProcessedAt: transaction.ProcessedAt, ID: transaction.ID}
+}
+
+// Encode makes the cursor an opaque token for clients to send back
+func (c Cursor) Encode() string {
+	raw := fmt.Sprintf("%d:%d", c.ProcessedAt.UnixMicro(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor reads a token made by Cursor.Encode
+func DecodeCursor(token string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	micros, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	at, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{ProcessedAt: time.UnixMicro(at).UTC(), ID: uint(n)}, nil
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	processedAt := time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC)
+	cursor := CursorAfter(Transaction{ID: 42, ProcessedAt: processedAt})
+
+	decoded, err := DecodeCursor(cursor.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, uint(42), decoded.ID)
+	assert.True(t, processedAt.Equal(decoded.ProcessedAt))
+
+	for _, token := range []string{"", "not base64!", "MTIz", "YTpi"} {
+		_, err := DecodeCursor(token)
+		assert.ErrorIs(t, err, ErrInvalidCursor, token)
+	}
+}
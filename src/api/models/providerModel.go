@@ -0,0 +1,147 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// providerNamePattern is what a provider name, sent as Source-Type, may look like
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+// Provider is a source of transactions, named by the Source-Type header of its requests.
+// Only enabled providers may create transactions, in their allowed states and up to their MaxAmount.
+type Provider struct {
+	Name          string   `gorm:"primaryKey;type:varchar(50)" json:"name"`
+	Enabled       bool     `gorm:"not null" json:"enabled"`
+	AllowedStates []string `gorm:"serializer:json;type:jsonb;not null" json:"allowed_states"`
+	MaxAmount     Money    `gorm:"type:decimal(20,3);not null;default:0" json:"max_amount" swaggertype:"number"` // per transaction, 0 for MaxTransactionAmount
+	// requests per second the provider may send, and how many at once, 0 for the configured defaults
+	RateLimit float64 `gorm:"not null;default:0" json:"rate_limit"`
+	RateBurst int     `gorm:"not null;default:0" json:"rate_burst"`
+	// credentials the provider signs requests with, the previous secret stays active during a rotation
+	Secret         string    `gorm:"type:varchar(255)" json:"-"`
+	PreviousSecret string    `gorm:"type:varchar(255)" json:"-"`
+	HasSecret      bool      `gorm:"-" json:"has_secret"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// ProviderRequest creates a provider or changes the fields it sets
+type ProviderRequest struct {
+	Name          string   `json:"name"` // only when creating
+	Enabled       *bool    `json:"enabled"`
+	AllowedStates []string `json:"allowed_states"`
+	MaxAmount     *Money   `json:"max_amount" swaggertype:"number"`
+	RateLimit     *float64 `json:"rate_limit"`
+	RateBurst     *int     `json:"rate_burst"`
+	// Secret rotates the credentials: it becomes the current secret and the current one the previous
+	Secret string `json:"secret"`
+	// RetirePreviousSecret ends a rotation by deactivating the previous secret
+	RetirePreviousSecret bool `json:"retire_previous_secret"`
+}
+
+// DefaultProvider is a provider as the registry is seeded with: enabled for win and lost with the default limit
+func DefaultProvider(name string) Provider {
+	return Provider{Name: name, Enabled: true, AllowedStates: []string{"win", "lost"}}
+}
+
+// Secrets are the active secrets, the current one first
+func (p *Provider) Secrets() []string {
+	var secrets []string
+	for _, secret := range []string{p.Secret, p.PreviousSecret} {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// Limit is the largest amount of a single transaction of the provider
+func (p *Provider) Limit() Money {
+	if p.MaxAmount > 0 && p.MaxAmount < MaxTransactionAmount {
+		return p.MaxAmount
+	}
+	return MaxTransactionAmount
+}
+
+// Admits checks a transaction against the provider's allowed states and limit.
+// It returns a *ValidationError naming each failing field, or nil.
+func (p *Provider) Admits(r *TransactionRequest) error {
+	var fields []FieldError
+	allowed := false
+	for _, state := range p.AllowedStates {
+		if r.State == state {
+			allowed = true
+		}
+	}
+	if !allowed {
+		fields = append(fields, FieldError{"state", fmt.Sprintf("is not allowed for provider %s", p.Name)})
+	}
+	if r.Amount > p.Limit() {
+		fields = append(fields, FieldError{"amount", fmt.Sprintf("must not exceed %s for provider %s", p.Limit(), p.Name)})
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// Apply validates a provider request and sets its fields on p, creating it when p is new
+func (r *ProviderRequest) Apply(p *Provider, create bool) error {
+	var fields []FieldError
+	if create {
+		if !providerNamePattern.MatchString(r.Name) {
+			fields = append(fields, FieldError{"name", "must be 1 to 50 lowercase letters, digits, _ or -, starting with a letter or digit"})
+		}
+		*p = DefaultProvider(r.Name)
+	}
+	if r.AllowedStates != nil {
+		if len(r.AllowedStates) == 0 {
+			fields = append(fields, FieldError{"allowed_states", "must hold win, lost or both"})
+		}
+		for _, state := range r.AllowedStates {
+			if !ValidState(state) {
+				fields = append(fields, FieldError{"allowed_states", fmt.Sprintf("has unknown state %q", state)})
+			}
+		}
+	}
+	if r.MaxAmount != nil && (*r.MaxAmount < 0 || *r.MaxAmount > MaxTransactionAmount) {
+		fields = append(fields, FieldError{"max_amount", fmt.Sprintf("must be between 0 and %s", MaxTransactionAmount)})
+	}
+	if r.RateLimit != nil && *r.RateLimit < 0 {
+		fields = append(fields, FieldError{"rate_limit", "must not be negative"})
+	}
+	if r.RateBurst != nil && *r.RateBurst < 0 {
+		fields = append(fields, FieldError{"rate_burst", "must not be negative"})
+	}
+	if r.RetirePreviousSecret && r.Secret != "" {
+		fields = append(fields, FieldError{"retire_previous_secret", "can't be combined with a new secret"})
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+
+	if r.Enabled != nil {
+		p.Enabled = *r.Enabled
+	}
+	if r.AllowedStates != nil {
+		p.AllowedStates = r.AllowedStates
+	}
+	if r.MaxAmount != nil {
+		p.MaxAmount = *r.MaxAmount
+	}
+	if r.RateLimit != nil {
+		p.RateLimit = *r.RateLimit
+	}
+	if r.RateBurst != nil {
+		p.RateBurst = *r.RateBurst
+	}
+	if r.Secret != "" {
+		p.PreviousSecret, p.Secret = p.Secret, r.Secret
+	}
+	if r.RetirePreviousSecret {
+		p.PreviousSecret = ""
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderAdmits(t *testing.T) {
+	provider := Provider{Name: "payment", Enabled: true, AllowedStates: []string{"win"}, MaxAmount: 500000}
+
+	tests := []struct {
+		name   string
+		req    TransactionRequest
+		fields []string
+	}{
+		{"allowed", TransactionRequest{State: "win", Amount: 500000}, nil},
+		{"state not allowed", TransactionRequest{State: "lost", Amount: 1000}, []string{"state"}},
+		{"over the provider limit", TransactionRequest{State: "win", Amount: 500001}, []string{"amount"}},
+		{"both", TransactionRequest{State: "lost", Amount: 600000}, []string{"state", "amount"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provider.Admits(&tt.req)
+			if tt.fields == nil {
+				assert.NoError(t, err)
+				return
+			}
+			var fields []string
+			for _, field := range err.(*ValidationError).Fields {
+				fields = append(fields, field.Field)
+			}
+			assert.Equal(t, tt.fields, fields)
+		})
+	}
+
+	unlimited := DefaultProvider("game")
+	assert.Equal(t, MaxTransactionAmount, unlimited.Limit(), "no limit of its own means the global one")
+}
+
+func TestProviderRequestApply(t *testing.T) {
+	enabled := false
+	maxAmount := Money(1000)
+	tooMuch := MaxTransactionAmount + 1
+	negativeRate := -1.0
+	rateLimit, rateBurst := 5.0, 10
+
+	t.Run("create with defaults", func(t *testing.T) {
+		provider := Provider{}
+		assert.NoError(t, (&ProviderRequest{Name: "casino-1", Secret: "s1"}).Apply(&provider, true))
+		assert.Equal(t, "casino-1", provider.Name)
+		assert.True(t, provider.Enabled)
+		assert.Equal(t, []string{"win", "lost"}, provider.AllowedStates)
+		assert.Equal(t, []string{"s1"}, provider.Secrets())
+	})
+
+	t.Run("invalid fields", func(t *testing.T) {
+		provider := Provider{}
+		err := (&ProviderRequest{Name: "Casino 1", AllowedStates: []string{"draw"}, MaxAmount: &tooMuch, RateLimit: &negativeRate}).Apply(&provider, true)
+		var fields []string
+		for _, field := range err.(*ValidationError).Fields {
+			fields = append(fields, field.Field)
+		}
+		assert.Equal(t, []string{"name", "allowed_states", "max_amount", "rate_limit"}, fields)
+	})
+
+	t.Run("update keeps unset fields", func(t *testing.T) {
+		provider := DefaultProvider("game")
+		provider.Secret = "s1"
+		assert.NoError(t, (&ProviderRequest{Enabled: &enabled, MaxAmount: &maxAmount, RateLimit: &rateLimit, RateBurst: &rateBurst}).Apply(&provider, false))
+		assert.False(t, provider.Enabled)
+		assert.Equal(t, maxAmount, provider.MaxAmount)
+		assert.Equal(t, rateLimit, provider.RateLimit)
+		assert.Equal(t, rateBurst, provider.RateBurst)
+		assert.Equal(t, []string{"win", "lost"}, provider.AllowedStates)
+		assert.Equal(t, []string{"s1"}, provider.Secrets())
+	})
+
+	t.Run("secret rotation", func(t *testing.T) {
+		provider := DefaultProvider("game")
+		provider.Secret = "s1"
+		assert.NoError(t, (&ProviderRequest{Secret: "s2"}).Apply(&provider, false))
+		assert.Equal(t, []string{"s2", "s1"}, provider.Secrets(), "both secrets are active during the rotation")
+		assert.NoError(t, (&ProviderRequest{Secret: "s3"}).Apply(&provider, false))
+		assert.Equal(t, []string{"s3", "s2"}, provider.Secrets(), "at most two secrets are active")
+		assert.NoError(t, (&ProviderRequest{RetirePreviousSecret: true}).Apply(&provider, false))
+		assert.Equal(t, []string{"s3"}, provider.Secrets())
+	})
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// RequestNonce is a nonce a provider signed a request with, kept until the request could no longer be replayed
+type RequestNonce struct {
+	Provider  string    `gorm:"primaryKey;type:varchar(50)" json:"provider"`
+	Nonce     string    `gorm:"primaryKey;type:varchar(128)" json:"nonce"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+}
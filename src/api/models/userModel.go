@@ -2,50 +2,126 @@ package models
 
 import "time"
 
+// account statuses, only active accounts accept transactions
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusClosed    = "closed"
+)
+
 type User struct {
-	ID      uint    `gorm:"primaryKey" json:"id"`
-	Balance float64 `gorm:"not null;default:0.00" json:"balance"` // Removed explicit type
-	Version int     `gorm:"type:int;default:1"`                   // Optimistic locking
+	ID      uint     `gorm:"primaryKey" json:"id"`
+	Status  string   `gorm:"type:varchar(20);not null;default:active" json:"status"`
+	Version int      `gorm:"type:int;default:1"` // Optimistic locking
+	Wallets []Wallet `gorm:"foreignKey:UserID" json:"wallets"`
+}
+
+// Wallet holds a user's balance in one currency
+type Wallet struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	UserID   uint   `gorm:"not null;uniqueIndex:idx_wallet_user_currency" json:"user_id"`
+	Currency string `gorm:"type:varchar(3);not null;uniqueIndex:idx_wallet_user_currency" json:"currency"`
+	Balance  Money  `gorm:"type:decimal(20,3);not null;default:0" json:"balance" swaggertype:"number"`
+	Version  int    `gorm:"type:int;default:1" json:"-"` // Optimistic locking
 }
 
 type Transaction struct {
-	ID            uint      `gorm:"primaryKey" json:"id"`
-	TransactionID string    `gorm:"unique;not null" json:"transaction_id"`
-	Amount        float64   `gorm:"not null" json:"amount"` // Removed explicit type
-	State         string    `gorm:"type:varchar(10);not null" json:"state"`
-	SourceType    string    `gorm:"type:varchar(50);not null" json:"source_type"`
-	UserID        uint      `gorm:"not null" json:"user_id"`
-	ProcessedAt   time.Time `gorm:"autoCreateTime" json:"processed_at"` // Automatically set to current time
-	Canceled      bool      `gorm:"default:false" json:"canceled"`
-}
-
-// type User struct {
-// 	ID      uint    `gorm:"primaryKey" json:"id"`
-// 	Balance float64 `gorm:"type:decimal(10,2);not null;default:0.00" json:"balance"`
-
-// }
-
-//	type Transaction struct {
-//		ID            uint      `gorm:"primaryKey" json:"id"`
-//		TransactionID string    `gorm:"unique;not null" json:"transaction_id"`
-//		Amount        float64   `gorm:"type:decimal(10,2);not null" json:"amount"`
-//		State         string    `gorm:"type:varchar(10);not null" json:"state"`
-//		SourceType    string    `gorm:"type:varchar(50);not null" json:"source_type"`
-//		UserID        uint      `gorm:"not null" json:"user_id"`
-//		ProcessedAt   time.Time `gorm:"autoCreateTime" json:"processed_at"`
-//		Canceled      bool      `gorm:"default:false" json:"canceled"`
-//	}
+	ID            uint       `gorm:"primaryKey;index:idx_transactions_user_page,priority:3,sort:desc" json:"id"`
+	TransactionID string     `gorm:"type:varchar(64);unique;not null" json:"transaction_id"` // at most MaxTransactionIDLength
+	Amount        Money      `gorm:"type:decimal(20,3);not null" json:"amount" swaggertype:"number"`
+	Currency      string     `gorm:"type:varchar(3);not null" json:"currency"`
+	State         string     `gorm:"type:varchar(10);not null" json:"state"`
+	SourceType    string     `gorm:"type:varchar(50);not null" json:"source_type"`
+	UserID        uint       `gorm:"not null;index:idx_transactions_user_page,priority:1" json:"user_id"`
+	ProcessedAt   time.Time  `gorm:"autoCreateTime;index:idx_transactions_user_page,priority:2,sort:desc;index" json:"processed_at"` // Automatically set to current time
+	Canceled      bool       `gorm:"default:false" json:"canceled"`
+	CanceledAt    *time.Time `json:"canceled_at,omitempty"`
+	CancelReason  string     `gorm:"type:varchar(50)" json:"cancel_reason,omitempty"`
+}
+
+// SkippedTransaction is a cancellation candidate that was left alone, and why
+type SkippedTransaction struct {
+	ID     uint   `json:"id"`
+	Reason string `json:"reason"`
+}
+
 type TransactionRequest struct {
-	State         string  `json:"state" binding:"required"`
-	Amount        float64 `json:"amount" binding:"required"`
-	TransactionID string  `json:"transactionId" binding:"required"`
-	SourceType    string  `json:"source_type"`
+	State         string `json:"state" binding:"required"`
+	Amount        Money  `json:"amount" binding:"required" swaggertype:"number"`
+	Currency      string `json:"currency" binding:"required"`
+	TransactionID string `json:"transactionId" binding:"required"`
+	UserID        uint   `json:"userId"` // falls back to the User-Id header when omitted
+	SourceType    string `json:"source_type"`
+}
+type UserRequest struct {
+	Currencies []string `json:"currencies"` // wallets to open, the default currency when empty
+}
+type WalletRequest struct {
+	Currency string `json:"currency" binding:"required"`
+}
+type CancelRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+type UserStatusRequest struct {
+	Status string `json:"status" binding:"required"`
 }
+
+// ValidUserStatus reports whether status is one of the known account statuses
+func ValidUserStatus(status string) bool {
+	switch status {
+	case UserStatusActive, UserStatusSuspended, UserStatusClosed:
+		return true
+	}
+	return false
+}
+
 type UserInfo struct {
 	User        User          `json:"user"`
 	Transaction []Transaction `json:"transaction"`
+	Replayed    bool          `json:"replayed,omitempty"`    // a retried transactionId answered with the stored result
+	NextCursor  string        `json:"next_cursor,omitempty"` // pass as cursor to read the next page, empty on the last page
 }
 
-// Balance float64 `gorm:"type:decimal(10,2);not null;default:0.00" json:"balance"`
+// WalletBalance is a wallet's balance at some instant
+type WalletBalance struct {
+	Currency string `json:"currency"`
+	Balance  Money  `json:"balance" swaggertype:"number"`
+}
+
+// BalanceAsOf is a user's wallet balances as they stood at At
+type BalanceAsOf struct {
+	UserID  uint            `json:"user_id"`
+	At      time.Time       `json:"at"`
+	Wallets []WalletBalance `json:"wallets"`
+}
 
-// Amount        float64   `gorm:"type:decimal(10,2);not null" json:"amount"`
+// transaction statuses reported to providers
+const (
+	TransactionStatusProcessed = "processed"
+	TransactionStatusCanceled  = "canceled"
+)
+
+// TransactionStatus answers a provider's status check on one of its transactionIds
+type TransactionStatus struct {
+	Transaction Transaction `json:"transaction"`
+	Status      string      `json:"status"` // processed or canceled
+	User        User        `json:"user"`
+}
+
+// cancellation reason codes, CancelReasonOddJob is reserved for the odd transaction job
+const (
+	CancelReasonOddJob          = "odd_transaction_job"
+	CancelReasonProviderRequest = "provider_request"
+	CancelReasonDuplicate       = "duplicate"
+	CancelReasonFraud           = "fraud"
+	CancelReasonCorrection      = "support_correction"
+)
+
+// ValidManualCancelReason reports whether support staff may cancel with reason
+func ValidManualCancelReason(reason string) bool {
+	switch reason {
+	case CancelReasonProviderRequest, CancelReasonDuplicate, CancelReasonFraud, CancelReasonCorrection:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxTransactionAmount caps the amount of a single transaction, 1,000,000 in the currency's major unit
+const MaxTransactionAmount Money = 1000000 * 1000
+
+// MaxTransactionIDLength caps the length of a provider transactionId
+const MaxTransactionIDLength = 64
+
+// transactionIDPattern is what a provider transactionId may look like: letters, digits and . _ : -, starting with a letter or digit
+var transactionIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+
+// FieldError is a problem with one field of a request, named as in its JSON body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a request that failed validation
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		problems[i] = field.Field + " " + field.Message
+	}
+	return "invalid request: " + strings.Join(problems, "; ")
+}
+
+// ValidState reports whether state is one of the transaction states, a win credits the wallet and a loss debits it
+func ValidState(state string) bool {
+	return state == "win" || state == "lost"
+}
+
+// Validate checks the rules binding tags don't: a known state, a positive amount
+// no larger than MaxTransactionAmount, and a well-formed transactionId.
+// It returns a *ValidationError naming each failing field, or nil.
+func (r *TransactionRequest) Validate() error {
+	var fields []FieldError
+	if !ValidState(r.State) {
+		fields = append(fields, FieldError{"state", "must be win or lost"})
+	}
+	if r.Amount <= 0 {
+		fields = append(fields, FieldError{"amount", "must be positive"})
+	} else if r.Amount > MaxTransactionAmount {
+		fields = append(fields, FieldError{"amount", fmt.Sprintf("must not exceed %s", MaxTransactionAmount)})
+	}
+	if len(r.TransactionID) > MaxTransactionIDLength {
+		fields = append(fields, FieldError{"transactionId", fmt.Sprintf("must not be longer than %d characters", MaxTransactionIDLength)})
+	} else if !transactionIDPattern.MatchString(r.TransactionID) {
+		fields = append(fields, FieldError{"transactionId", "may only hold letters, digits and . _ : - and must start with a letter or digit"})
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
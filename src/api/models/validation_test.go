@@ -0,0 +1,53 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionRequestValidate(t *testing.T) {
+	valid := TransactionRequest{State: "win", Amount: 10150, Currency: "USD", TransactionID: "tx_123"}
+
+	tests := []struct {
+		name   string
+		modify func(r *TransactionRequest)
+		fields []string
+	}{
+		{"valid", func(r *TransactionRequest) {}, nil},
+		{"lost", func(r *TransactionRequest) { r.State = "lost" }, nil},
+		{"id with separators", func(r *TransactionRequest) { r.TransactionID = "prov-1:round.7_a" }, nil},
+		{"maximum amount", func(r *TransactionRequest) { r.Amount = MaxTransactionAmount }, nil},
+		{"longest id", func(r *TransactionRequest) { r.TransactionID = strings.Repeat("a", MaxTransactionIDLength) }, nil},
+		{"unknown state", func(r *TransactionRequest) { r.State = "completed" }, []string{"state"}},
+		{"zero amount", func(r *TransactionRequest) { r.Amount = 0 }, []string{"amount"}},
+		{"negative amount", func(r *TransactionRequest) { r.Amount = -1 }, []string{"amount"}},
+		{"oversized amount", func(r *TransactionRequest) { r.Amount = MaxTransactionAmount + 1 }, []string{"amount"}},
+		{"overlong id", func(r *TransactionRequest) { r.TransactionID = strings.Repeat("a", MaxTransactionIDLength+1) }, []string{"transactionId"}},
+		{"id with spaces", func(r *TransactionRequest) { r.TransactionID = "tx 1" }, []string{"transactionId"}},
+		{"id starting with a separator", func(r *TransactionRequest) { r.TransactionID = "-tx1" }, []string{"transactionId"}},
+		{"every field", func(r *TransactionRequest) { r.State, r.Amount, r.TransactionID = "", 0, "" }, []string{"state", "amount", "transactionId"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.modify(&req)
+			err := req.Validate()
+			if tt.fields == nil {
+				assert.NoError(t, err)
+				return
+			}
+			validationErr, ok := err.(*ValidationError)
+			if !assert.True(t, ok, "want a *ValidationError, got %v", err) {
+				return
+			}
+			var fields []string
+			for _, field := range validationErr.Fields {
+				fields = append(fields, field.Field)
+			}
+			assert.Equal(t, tt.fields, fields)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Kind groups domain errors by how a caller should react to them
+type Kind int
+
+const (
+	KindNotFound      Kind = iota + 1 // the thing asked for doesn't exist
+	KindInvalid                       // the request itself is wrong
+	KindConflict                      // the request clashes with stored state: duplicates, version conflicts, closed accounts
+	KindUnprocessable                 // the request is well formed but can't be applied, e.g. insufficient funds
+	KindUnavailable                   // the database can't be reached right now, retrying later may work
+)
+
+// Error is a domain error with a stable machine-readable code.
+// The sentinels below are *Error values, so callers match them with errors.Is
+// and read the kind and code of any of them with errors.As.
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(kind Kind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+// repository errors callers can match with errors.Is
+var (
+	ErrUnknownAccount      = newError(KindNotFound, "unknown_account", "unknown account")
+	ErrAccountInactive     = newError(KindConflict, "account_inactive", "account is not active")
+	ErrInvalidStatus       = newError(KindInvalid, "invalid_status", "invalid account status")
+	ErrAccountClosed       = newError(KindConflict, "account_closed", "account is closed")
+	ErrUnknownCurrency     = newError(KindInvalid, "unsupported_currency", "unsupported currency")
+	ErrAmountPrecision     = newError(KindInvalid, "amount_precision", "amount has more decimal places than the currency allows")
+	ErrNoWallet            = newError(KindUnprocessable, "no_wallet", "user has no wallet in this currency")
+	ErrWalletExists        = newError(KindConflict, "wallet_exists", "user already has a wallet in this currency")
+	ErrInsufficientFunds   = newError(KindUnprocessable, "insufficient_funds", "balance cannot be negative")
+	ErrVersionConflict     = newError(KindConflict, "version_conflict", "version conflict, the balance changed concurrently")
+	ErrAlreadyCanceled     = newError(KindConflict, "already_canceled", "transaction already canceled")
+	ErrRunNotFound         = newError(KindNotFound, "run_not_found", "cancellation run not found")
+	ErrTransactionNotFound = newError(KindNotFound, "transaction_not_found", "transaction not found")
+	ErrInvalidCancelReason = newError(KindInvalid, "invalid_cancel_reason", "invalid cancellation reason")
+	ErrProviderNotFound    = newError(KindNotFound, "provider_not_found", "provider not found")
+	ErrProviderExists      = newError(KindConflict, "provider_exists", "provider already exists")
+	ErrProviderDisabled    = newError(KindConflict, "provider_disabled", "provider is disabled")
+	// ErrTransactionConflict is a reused transactionId whose payload differs from the stored one
+	ErrTransactionConflict = newError(KindConflict, "duplicate_transaction", "transactionId already used with a different payload")
+	// ErrUnavailable stands in for database failures that are worth retrying later
+	ErrUnavailable = newError(KindUnavailable, "unavailable", "service temporarily unavailable")
+)
+
+// AsError returns the domain error behind err, classifying lost or refused
+// database connections as ErrUnavailable. It returns nil for any other error.
+func AsError(err error) *Error {
+	var domainErr *Error
+	if errors.As(err, &domainErr) {
+		return domainErr
+	}
+	if unavailable(err) {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// uniqueViolation reports whether err is a unique index rejecting a row, translated by gorm or straight from postgres
+func uniqueViolation(err error) bool {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func unavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// connection exceptions, insufficient resources and operator interventions such as shutdowns
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "53") || strings.HasPrefix(pgErr.Code, "57P")
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
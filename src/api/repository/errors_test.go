@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected *Error
+	}{
+		{"sentinel", ErrInsufficientFunds, ErrInsufficientFunds},
+		{"wrapped sentinel", fmt.Errorf("failed to apply transaction %w", ErrVersionConflict), ErrVersionConflict},
+		{"bad connection", fmt.Errorf("failed to list transactions %w", driver.ErrBadConn), ErrUnavailable},
+		{"too many connections", &pgconn.PgError{Code: "53300"}, ErrUnavailable},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, ErrUnavailable},
+		{"constraint violation", &pgconn.PgError{Code: "23503"}, nil},
+		{"plain error", errors.New("boom"), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, AsError(test.err))
+		})
+	}
+}
+
+func TestErrorsKeepTheirMessages(t *testing.T) {
+	assert.Equal(t, "balance cannot be negative", ErrInsufficientFunds.Error())
+	assert.True(t, errors.Is(fmt.Errorf("wrapped %w", ErrUnknownAccount), ErrUnknownAccount))
+	assert.False(t, errors.Is(ErrUnknownAccount, ErrRunNotFound), "sentinels of one kind stay distinct")
+}
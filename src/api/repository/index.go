@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 	model "github.com/myrachanto/entaingo/src/api/models"
@@ -63,16 +65,79 @@ type indexRepo struct {
 	Bizname string `json:"bizname,omitempty"`
 }
 
-func (indexRepo indexRepo) Dbsetup() error {
+// PoolConfig sizes the connection pool shared by the whole process
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// LoadPoolConfig reads DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME,
+// falling back to defaults for the ones that aren't set
+func LoadPoolConfig() (PoolConfig, error) {
+	config := PoolConfig{
+		MaxOpenConns:    25,
+		MaxIdleConns:    10,
+		ConnMaxLifetime: 30 * time.Minute,
+		ConnMaxIdleTime: 5 * time.Minute,
+	}
+	if v := os.Getenv("DB_MAX_OPEN_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return config, fmt.Errorf("invalid DB_MAX_OPEN_CONNS %q", v)
+		}
+		config.MaxOpenConns = n
+	}
+	if v := os.Getenv("DB_MAX_IDLE_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return config, fmt.Errorf("invalid DB_MAX_IDLE_CONNS %q", v)
+		}
+		config.MaxIdleConns = n
+	}
+	if v := os.Getenv("DB_CONN_MAX_LIFETIME"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid DB_CONN_MAX_LIFETIME %q: %w", v, err)
+		}
+		config.ConnMaxLifetime = d
+	}
+	if v := os.Getenv("DB_CONN_MAX_IDLE_TIME"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid DB_CONN_MAX_IDLE_TIME %q: %w", v, err)
+		}
+		config.ConnMaxIdleTime = d
+	}
+	return config, nil
+}
+
+// Dbsetup opens the connection pool once, migrates the schema and seeds the default user.
+// The returned pool is shared by every repository and closed with DbClose on shutdown.
+func (indexRepo indexRepo) Dbsetup() (*gorm.DB, error) {
 	// Load the DB configuration using Viper
-	fmt.Println("step1 ...................................................")
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file in routes ", err)
 	}
 
-	fmt.Println("step2 ...................................................")
+	db, err := indexRepo.connect()
+	if err != nil {
+		return nil, err
+	}
+	if err := indexRepo.migrate(db); err != nil {
+		indexRepo.DbClose(db)
+		return nil, err
+	}
+	return db, nil
+}
 
+func (indexRepo indexRepo) connect() (*gorm.DB, error) {
+	pool, err := LoadPoolConfig()
+	if err != nil {
+		return nil, err
+	}
 	dsn := fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=%s",
 		os.Getenv("DB_HOST"),
@@ -89,22 +154,81 @@ func (indexRepo indexRepo) Dbsetup() error {
 		SkipDefaultTransaction: true,                                // Skip default transactions for performance
 		PrepareStmt:            true,                                // Caches prepared statements
 		Logger:                 logger.Default.LogMode(logger.Info), // Enables logging of SQL statements
+		TranslateError:         true,                                // Maps unique violations to gorm.ErrDuplicatedKey
 	})
 	if err != nil {
-		return fmt.Errorf("failed to connect to the database: %w", err)
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	return db, nil
+}
+
+func (indexRepo indexRepo) migrate(db *gorm.DB) error {
+	currency := DefaultCurrency()
+	// existing transactions predate wallets and belong to the default currency
+	if db.Migrator().HasTable(&model.Transaction{}) && !db.Migrator().HasColumn(&model.Transaction{}, "Currency") {
+		if err := db.Exec(fmt.Sprintf("ALTER TABLE transactions ADD COLUMN currency varchar(3) NOT NULL DEFAULT '%s'", currency)).Error; err != nil {
+			return fmt.Errorf("failed to add transaction currency: %w", err)
+		}
+		if err := db.Exec("ALTER TABLE transactions ALTER COLUMN currency DROP DEFAULT").Error; err != nil {
+			return fmt.Errorf("failed to add transaction currency: %w", err)
+		}
+	}
+
+	// transaction ids are capped at MaxTransactionIDLength, ids stored before the cap would keep the column from shrinking
+	if db.Migrator().HasTable(&model.Transaction{}) {
+		var overlong int64
+		if err := db.Model(&model.Transaction{}).Where("length(transaction_id) > ?", model.MaxTransactionIDLength).Count(&overlong).Error; err != nil {
+			return fmt.Errorf("failed to check transaction ids: %w", err)
+		}
+		if overlong > 0 {
+			return fmt.Errorf("%d transactions have a transaction_id longer than %d characters, shorten them before migrating", overlong, model.MaxTransactionIDLength)
+		}
 	}
+
 	// AutoMigrate your models
-	if err := db.AutoMigrate(&model.User{}, &model.Transaction{}); err != nil {
+	if err := db.AutoMigrate(&model.User{}, &model.Wallet{}, &model.Transaction{}, &model.JournalEntry{}, &model.Posting{}, &model.CancellationRun{}, &model.JobLease{}, &model.RequestNonce{}, &model.Provider{}); err != nil {
 		log.Fatalf("Error during migration: %v", err)
 	}
 
+	// move single balances from before wallets into a default currency wallet
+	if db.Migrator().HasColumn(&model.User{}, "balance") {
+		if err := db.Exec(`INSERT INTO wallets (user_id, currency, balance, version)
+			SELECT id, ?, balance, 1 FROM users
+			WHERE NOT EXISTS (SELECT 1 FROM wallets WHERE wallets.user_id = users.id AND wallets.currency = ?)`,
+			currency, currency).Error; err != nil {
+			return fmt.Errorf("failed to move balances into wallets: %w", err)
+		}
+		if err := db.Migrator().DropColumn(&model.User{}, "balance"); err != nil {
+			return fmt.Errorf("failed to drop users.balance: %w", err)
+		}
+	}
+
+	if err := postOpeningBalances(db); err != nil {
+		return err
+	}
+	if err := backfillCanceledAt(db); err != nil {
+		return err
+	}
+	if err := backfillBalanceAfter(db); err != nil {
+		return err
+	}
+
 	// Check if the default customer exists
 	var defaultUser model.User
 	if err := db.First(&defaultUser).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			// Create the default user if not found
 			defaultUser = model.User{
-				Balance: 0,
+				Status:  model.UserStatusActive,
+				Wallets: []model.Wallet{{Currency: currency}},
 			}
 			if err := db.Create(&defaultUser).Error; err != nil {
 				return fmt.Errorf("error creating default user: %v", err)
@@ -113,33 +237,14 @@ func (indexRepo indexRepo) Dbsetup() error {
 	}
 	return nil
 }
-func (indexRepo indexRepo) Getconnected() (*gorm.DB, error) {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file in routes ", err)
-	}
-	dsn := fmt.Sprintf(
-		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=%s",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_TIMEZONE"),
-	)
 
-	db, err := gorm.Open(postgres.New(postgres.Config{
-		DSN:                  dsn,  // Connection string for Postgres
-		PreferSimpleProtocol: true, // disables implicit prepared statement usage
-	}), &gorm.Config{
-		SkipDefaultTransaction: true,                                // Skip default transactions for performance
-		PrepareStmt:            true,                                // Caches prepared statements
-		Logger:                 logger.Default.LogMode(logger.Info), // Enables logging of SQL statements
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+// DefaultCurrency is the currency of new accounts that don't ask for one, from DEFAULT_CURRENCY
+func DefaultCurrency() string {
+	currency := model.NormalizeCurrency(os.Getenv("DEFAULT_CURRENCY"))
+	if !model.ValidCurrency(currency) {
+		return "USD"
 	}
-	return db, nil
+	return currency
 }
 func (indexRepo indexRepo) DbClose(GormDB *gorm.DB) {
 	sqlDB, err := GormDB.DB()
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPoolConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		t.Setenv("DB_MAX_OPEN_CONNS", "")
+		t.Setenv("DB_MAX_IDLE_CONNS", "")
+		t.Setenv("DB_CONN_MAX_LIFETIME", "")
+		t.Setenv("DB_CONN_MAX_IDLE_TIME", "")
+		config, err := LoadPoolConfig()
+		assert.NoError(t, err)
+		assert.Equal(t, PoolConfig{
+			MaxOpenConns:    25,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		}, config)
+	})
+
+	t.Run("from environment", func(t *testing.T) {
+		t.Setenv("DB_MAX_OPEN_CONNS", "50")
+		t.Setenv("DB_MAX_IDLE_CONNS", "20")
+		t.Setenv("DB_CONN_MAX_LIFETIME", "1h")
+		t.Setenv("DB_CONN_MAX_IDLE_TIME", "90s")
+		config, err := LoadPoolConfig()
+		assert.NoError(t, err)
+		assert.Equal(t, PoolConfig{
+			MaxOpenConns:    50,
+			MaxIdleConns:    20,
+			ConnMaxLifetime: time.Hour,
+			ConnMaxIdleTime: 90 * time.Second,
+		}, config)
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		t.Setenv("DB_MAX_OPEN_CONNS", "zero")
+		_, err := LoadPoolConfig()
+		assert.Error(t, err)
+
+		t.Setenv("DB_MAX_OPEN_CONNS", "")
+		t.Setenv("DB_CONN_MAX_LIFETIME", "forever")
+		_, err = LoadPoolConfig()
+		assert.Error(t, err)
+	})
+}
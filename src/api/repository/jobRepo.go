@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+
+	model "github.com/myrachanto/entaingo/src/api/models"
+	"gorm.io/gorm"
+)
+
+type JobrepoInterface interface {
+	GetCancellationRuns(limit int) ([]model.CancellationRun, error)
+	GetCancellationRun(runId uint) (*model.CancellationRun, error)
+}
+type jobrepository struct {
+	db *gorm.DB
+}
+
+// NewJobRepo builds the job history repository on the shared connection pool
+func NewJobRepo(db *gorm.DB) JobrepoInterface {
+	return &jobrepository{
+		db,
+	}
+}
+
+func saveCancellationRun(db *gorm.DB, run *model.CancellationRun) error {
+	if err := db.Create(run).Error; err != nil {
+		return fmt.Errorf("failed to save cancellation run %w", err)
+	}
+	return nil
+}
+
+// GetCancellationRuns lists the most recent runs first
+func (r *jobrepository) GetCancellationRuns(limit int) ([]model.CancellationRun, error) {
+	runs := []model.CancellationRun{}
+	if err := r.db.Order("started_at desc, id desc").Limit(limit).Find(&runs).Error; err != nil {
+		return nil, fmt.Errorf("failed to list cancellation runs %w", err)
+	}
+	return runs, nil
+}
+
+func (r *jobrepository) GetCancellationRun(runId uint) (*model.CancellationRun, error) {
+	run := &model.CancellationRun{}
+	err := r.db.First(run, runId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRunNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cancellation run %w", err)
+	}
+	return run, nil
+}
@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	model "github.com/myrachanto/entaingo/src/api/models"
+	"gorm.io/gorm"
+)
+
+// LeaderElector decides which replica runs a job that must only run once per interval.
+// A replica leads while it holds the job's lease; a dead leader's lease expires and another replica takes over.
+type LeaderElector interface {
+	// Acquire takes or renews the lease on name for ttl and reports whether this replica holds it
+	Acquire(ctx context.Context, name string, ttl time.Duration) (bool, error)
+	// Release gives up the lease if this replica holds it, so another replica can take over at once
+	Release(ctx context.Context, name string) error
+}
+
+// HolderID identifies this process as a lease holder
+func HolderID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+type dbLeaderElector struct {
+	db     *gorm.DB
+	holder string
+}
+
+// NewDbLeaderElector elects through lease rows in the job_leases table.
+// Expiry uses the database clock, so replicas don't need synchronized clocks.
+func NewDbLeaderElector(db *gorm.DB, holder string) LeaderElector {
+	return &dbLeaderElector{
+		db,
+		holder,
+	}
+}
+
+func (e *dbLeaderElector) Acquire(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	// insert the lease, or take it over when it is ours or has expired
+	result := e.db.WithContext(ctx).Exec(`INSERT INTO job_leases (name, holder, expires_at)
+		VALUES (?, ?, now() + ? * interval '1 millisecond')
+		ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE job_leases.holder = EXCLUDED.holder OR job_leases.expires_at < now()`,
+		name, e.holder, ttl.Milliseconds())
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to acquire lease %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (e *dbLeaderElector) Release(ctx context.Context, name string) error {
+	if err := e.db.WithContext(ctx).Where("name = ? AND holder = ?", name, e.holder).
+		Delete(&model.JobLease{}).Error; err != nil {
+		return fmt.Errorf("failed to release lease %w", err)
+	}
+	return nil
+}
+
+// MemoryLeases is an in-memory stand-in for the job_leases table, shared by the electors of simulated replicas
+type MemoryLeases struct {
+	mu     sync.Mutex
+	leases map[string]model.JobLease
+	Now    func() time.Time // clock, replaceable in tests
+}
+
+func NewMemoryLeases() *MemoryLeases {
+	return &MemoryLeases{
+		leases: map[string]model.JobLease{},
+		Now:    time.Now,
+	}
+}
+
+// Elector returns the elector of one replica
+func (m *MemoryLeases) Elector(holder string) LeaderElector {
+	return &memoryLeaderElector{
+		m,
+		holder,
+	}
+}
+
+type memoryLeaderElector struct {
+	leases *MemoryLeases
+	holder string
+}
+
+func (e *memoryLeaderElector) Acquire(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	e.leases.mu.Lock()
+	defer e.leases.mu.Unlock()
+	now := e.leases.Now()
+	lease, ok := e.leases.leases[name]
+	if ok && lease.Holder != e.holder && !lease.ExpiresAt.Before(now) {
+		return false, nil
+	}
+	e.leases.leases[name] = model.JobLease{Name: name, Holder: e.holder, ExpiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (e *memoryLeaderElector) Release(ctx context.Context, name string) error {
+	e.leases.mu.Lock()
+	defer e.leases.mu.Unlock()
+	if lease, ok := e.leases.leases[name]; ok && lease.Holder == e.holder {
+		delete(e.leases.leases, name)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLeaderElector(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 10, 22, 12, 0, 0, 0, time.UTC)
+	leases := NewMemoryLeases()
+	leases.Now = func() time.Time { return now }
+	first := leases.Elector("replica-1")
+	second := leases.Elector("replica-2")
+	ttl := 10 * time.Minute
+	lease := "cancel-odd-transactions"
+
+	leader, err := first.Acquire(ctx, lease, ttl)
+	assert.NoError(t, err)
+	assert.True(t, leader, "first replica takes the free lease")
+
+	leader, _ = second.Acquire(ctx, lease, ttl)
+	assert.False(t, leader, "second replica waits while the lease is held")
+
+	now = now.Add(8 * time.Minute)
+	leader, _ = first.Acquire(ctx, lease, ttl)
+	assert.True(t, leader, "leader renews its own lease")
+
+	now = now.Add(9 * time.Minute)
+	leader, _ = second.Acquire(ctx, lease, ttl)
+	assert.False(t, leader, "renewed lease hasn't expired yet")
+
+	// the leader dies without releasing
+	now = now.Add(2 * time.Minute)
+	leader, _ = second.Acquire(ctx, lease, ttl)
+	assert.True(t, leader, "expired lease fails over")
+
+	leader, _ = first.Acquire(ctx, lease, ttl)
+	assert.False(t, leader, "old leader lost the lease")
+
+	assert.NoError(t, first.Release(ctx, lease))
+	leader, _ = first.Acquire(ctx, lease, ttl)
+	assert.False(t, leader, "releasing someone else's lease does nothing")
+
+	assert.NoError(t, second.Release(ctx, lease))
+	leader, _ = first.Acquire(ctx, lease, ttl)
+	assert.True(t, leader, "released lease is free at once")
+}
@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"fmt"
+
+	model "github.com/myrachanto/entaingo/src/api/models"
+	"gorm.io/gorm"
+)
+
+// postEntry journals a change of delta on a wallet against the house account of its currency.
+// It must run inside the database transaction that changes the wallet balance.
+func postEntry(tx *gorm.DB, transactionId *uint, wallet model.Wallet, kind string, delta, balance model.Money) error {
+	if delta == 0 {
+		return nil
+	}
+	entry := model.JournalEntry{
+		TransactionID: transactionId,
+		Kind:          kind,
+		Postings: []model.Posting{
+			{Account: model.WalletAccount(wallet.ID), Currency: wallet.Currency, Amount: delta, BalanceAfter: &balance},
+			{Account: model.HouseAccount(wallet.Currency), Currency: wallet.Currency, Amount: -delta},
+		},
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return fmt.Errorf("failed to post journal entry %w", err)
+	}
+	return nil
+}
+
+// postOpeningBalances journals the balance of every wallet that has none of its own postings yet,
+// so wallets funded before the ledger existed still reconcile
+func postOpeningBalances(db *gorm.DB) error {
+	var wallets []model.Wallet
+	if err := db.Where("balance <> 0 AND NOT EXISTS (SELECT 1 FROM postings WHERE postings.account = 'wallet:' || wallets.id)").
+		Find(&wallets).Error; err != nil {
+		return fmt.Errorf("failed to find unjournaled wallets %w", err)
+	}
+	for _, wallet := range wallets {
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return postEntry(tx, nil, wallet, model.EntryOpening, wallet.Balance, wallet.Balance)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillBalanceAfter records the wallet balance on the wallet postings made before it was recorded,
+// as the running sum of the wallet's postings
+func backfillBalanceAfter(db *gorm.DB) error {
+	if err := db.Exec(`UPDATE postings SET balance_after = running.balance
+		FROM (SELECT id, SUM(amount) OVER (PARTITION BY account ORDER BY entry_id, id) AS balance
+			FROM postings WHERE account LIKE 'wallet:%') AS running
+		WHERE postings.id = running.id AND postings.balance_after IS NULL`).Error; err != nil {
+		return fmt.Errorf("failed to backfill balance_after %w", err)
+	}
+	return nil
+}
+
+// ReconcileUser checks each of the user's cached wallet balances against the journal
+// and lists the user's journal entries whose postings don't sum to zero
+func (r userrepository) ReconcileUser(userId uint) (*model.LedgerCheck, error) {
+	user, err := r.GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	gormdb := r.db
+
+	check := &model.LedgerCheck{
+		UserID:            user.ID,
+		Wallets:           []model.WalletCheck{},
+		UnbalancedEntries: []uint{},
+		Balanced:          true,
+	}
+	accounts := []string{}
+	for _, wallet := range user.Wallets {
+		account := model.WalletAccount(wallet.ID)
+		accounts = append(accounts, account)
+
+		var ledgerBalance model.Money
+		if err := gormdb.Model(&model.Posting{}).Select("COALESCE(SUM(amount), 0)").
+			Where("account = ?", account).Row().Scan(&ledgerBalance); err != nil {
+			return nil, fmt.Errorf("failed to sum postings %w", err)
+		}
+		walletCheck := model.WalletCheck{
+			WalletID:      wallet.ID,
+			Currency:      wallet.Currency,
+			Balance:       wallet.Balance,
+			LedgerBalance: ledgerBalance,
+			Balanced:      wallet.Balance == ledgerBalance,
+		}
+		check.Balanced = check.Balanced && walletCheck.Balanced
+		check.Wallets = append(check.Wallets, walletCheck)
+	}
+	if len(accounts) == 0 {
+		return check, nil
+	}
+
+	if err := gormdb.Model(&model.Posting{}).
+		Where("entry_id IN (?)", gormdb.Model(&model.Posting{}).Select("entry_id").Where("account IN ?", accounts)).
+		Group("entry_id").Having("SUM(amount) <> 0").Order("entry_id").
+		Pluck("entry_id", &check.UnbalancedEntries).Error; err != nil {
+		return nil, fmt.Errorf("failed to check journal entries %w", err)
+	}
+	if len(check.UnbalancedEntries) > 0 {
+		check.Balanced = false
+	}
+	return check, nil
+}
+
+// BalanceEvents reads balance changes back from the journal: the entries after afterSeq that moved a wallet
+// for a transaction, oldest first and at most limit, of userId or of every user when it is 0.
+// Each event is numbered by its entry id and carries the wallet balance its posting left.
+func (r *userrepository) BalanceEvents(afterSeq uint64, userId uint, limit int) ([]model.BalanceEvent, error) {
+	var rows []struct {
+		Seq           uint64
+		Kind          string
+		UserID        uint
+		Currency      string
+		Balance       model.Money
+		TransactionID uint
+	}
+	query := r.db.Table("journal_entries").
+		Select(`journal_entries.id AS seq, journal_entries.kind, wallets.user_id, postings.currency,
+			postings.balance_after AS balance, journal_entries.transaction_id`).
+		Joins("JOIN postings ON postings.entry_id = journal_entries.id").
+		Joins("JOIN wallets ON postings.account = 'wallet:' || wallets.id").
+		Where("journal_entries.id > ? AND journal_entries.transaction_id IS NOT NULL", afterSeq)
+	if userId != 0 {
+		query = query.Where("wallets.user_id = ?", userId)
+	}
+	if err := query.Order("journal_entries.id").Limit(limit).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read balance events %w", err)
+	}
+	if len(rows) == 0 {
+		return []model.BalanceEvent{}, nil
+	}
+
+	// a transaction and its cancellation share the row
+	ids := []uint{}
+	seen := map[uint]bool{}
+	for _, row := range rows {
+		if !seen[row.TransactionID] {
+			seen[row.TransactionID] = true
+			ids = append(ids, row.TransactionID)
+		}
+	}
+	var transactions []model.Transaction
+	if err := r.db.Where("id IN ?", ids).Find(&transactions).Error; err != nil {
+		return nil, fmt.Errorf("failed to read balance event transactions %w", err)
+	}
+	byId := map[uint]model.Transaction{}
+	for _, transaction := range transactions {
+		byId[transaction.ID] = transaction
+	}
+
+	events := []model.BalanceEvent{}
+	for _, row := range rows {
+		kind := model.BalanceEventTransaction
+		if row.Kind == model.EntryCancel {
+			kind = model.BalanceEventCancellation
+		}
+		events = append(events, model.BalanceEvent{
+			Seq:         row.Seq,
+			Kind:        kind,
+			UserID:      row.UserID,
+			Currency:    row.Currency,
+			Balance:     row.Balance,
+			Transaction: byId[row.TransactionID],
+		})
+	}
+	return events, nil
+}
+
+// LastEventSeq is the id of the latest journal entry, 0 when the journal is empty
+func (r *userrepository) LastEventSeq() (uint64, error) {
+	var seq uint64
+	if err := r.db.Model(&model.JournalEntry{}).Select("COALESCE(MAX(id), 0)").Row().Scan(&seq); err != nil {
+		return 0, fmt.Errorf("failed to read the last journal entry %w", err)
+	}
+	return seq, nil
+}
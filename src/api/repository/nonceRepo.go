@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	model "github.com/myrachanto/entaingo/src/api/models"
+	"gorm.io/gorm"
+)
+
+// NonceStore remembers the nonces of signed requests, so a captured request can't be replayed
+type NonceStore interface {
+	// Remember records provider's nonce for ttl and reports whether it was unused
+	Remember(ctx context.Context, provider, nonce string, ttl time.Duration) (bool, error)
+}
+
+// noncePruneEvery is how many nonces are recorded between deletions of the expired ones
+const noncePruneEvery = 1000
+
+type dbNonceStore struct {
+	db    *gorm.DB
+	count uint64
+}
+
+// NewDbNonceStore keeps nonces in the request_nonces table, shared by every replica.
+// Expiry uses the database clock, like job leases.
+func NewDbNonceStore(db *gorm.DB) NonceStore {
+	return &dbNonceStore{db: db}
+}
+
+func (s *dbNonceStore) Remember(ctx context.Context, provider, nonce string, ttl time.Duration) (bool, error) {
+	// insert the nonce, or reuse the row of an expired one
+	result := s.db.WithContext(ctx).Exec(`INSERT INTO request_nonces (provider, nonce, expires_at)
+		VALUES (?, ?, now() + ? * interval '1 millisecond')
+		ON CONFLICT (provider, nonce) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE request_nonces.expires_at < now()`,
+		provider, nonce, ttl.Milliseconds())
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to record nonce %w", result.Error)
+	}
+	if atomic.AddUint64(&s.count, 1)%noncePruneEvery == 0 {
+		// the nonce is recorded either way, a failed prune is retried with the next batch
+		if err := s.db.WithContext(ctx).Where("expires_at < now()").Delete(&model.RequestNonce{}).Error; err != nil {
+			log.Println("Failed to prune expired nonces: ", err)
+		}
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// MemoryNonces is an in-memory stand-in for the request_nonces table
+type MemoryNonces struct {
+	mu     sync.Mutex
+	nonces map[[2]string]time.Time
+	Now    func() time.Time // clock, replaceable in tests
+}
+
+func NewMemoryNonces() *MemoryNonces {
+	return &MemoryNonces{
+		nonces: map[[2]string]time.Time{},
+		Now:    time.Now,
+	}
+}
+
+func (m *MemoryNonces) Remember(ctx context.Context, provider, nonce string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.Now()
+	key := [2]string{provider, nonce}
+	if expiresAt, ok := m.nonces[key]; ok && !expiresAt.Before(now) {
+		return false, nil
+	}
+	m.nonces[key] = now.Add(ttl)
+	return true, nil
+}
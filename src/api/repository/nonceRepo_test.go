@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryNonces(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 10, 22, 12, 0, 0, 0, time.UTC)
+	nonces := NewMemoryNonces()
+	nonces.Now = func() time.Time { return now }
+
+	fresh, err := nonces.Remember(ctx, "game", "n-1", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, fresh)
+	fresh, _ = nonces.Remember(ctx, "game", "n-1", time.Minute)
+	assert.False(t, fresh, "a nonce is only used once")
+	fresh, _ = nonces.Remember(ctx, "server", "n-1", time.Minute)
+	assert.True(t, fresh, "nonces are per provider")
+
+	now = now.Add(2 * time.Minute)
+	fresh, _ = nonces.Remember(ctx, "game", "n-1", time.Minute)
+	assert.True(t, fresh, "an expired nonce can't replay anything the window would accept")
+}
@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+
+	model "github.com/myrachanto/entaingo/src/api/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ProviderRepoInterface interface {
+	GetProviders() ([]model.Provider, error)
+	GetProvider(name string) (*model.Provider, error)
+	CreateProvider(provider *model.Provider) (*model.Provider, error)
+	UpdateProvider(name string, update func(provider *model.Provider) error) (*model.Provider, error)
+	DeleteProvider(name string) error
+	SeedProviders(providers []model.Provider) error
+}
+type providerrepository struct {
+	db *gorm.DB
+}
+
+// NewProviderRepo builds the provider registry repository on the shared connection pool
+func NewProviderRepo(db *gorm.DB) ProviderRepoInterface {
+	return &providerrepository{
+		db,
+	}
+}
+
+func (r *providerrepository) GetProviders() ([]model.Provider, error) {
+	providers := []model.Provider{}
+	if err := r.db.Order("name").Find(&providers).Error; err != nil {
+		return nil, fmt.Errorf("failed to list providers %w", err)
+	}
+	for i := range providers {
+		providers[i].HasSecret = providers[i].Secret != ""
+	}
+	return providers, nil
+}
+
+func (r *providerrepository) GetProvider(name string) (*model.Provider, error) {
+	provider := &model.Provider{}
+	err := r.db.Where("name = ?", name).First(provider).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrProviderNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get provider %w", err)
+	}
+	provider.HasSecret = provider.Secret != ""
+	return provider, nil
+}
+
+func (r *providerrepository) CreateProvider(provider *model.Provider) (*model.Provider, error) {
+	err := r.db.Create(provider).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrProviderExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider %w", err)
+	}
+	provider.HasSecret = provider.Secret != ""
+	return provider, nil
+}
+
+// UpdateProvider applies update to the stored provider under a row lock,
+// so concurrent changes, such as two secret rotations, don't overwrite each other
+func (r *providerrepository) UpdateProvider(name string, update func(provider *model.Provider) error) (*model.Provider, error) {
+	provider := &model.Provider{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(provider).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrProviderNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get provider %w", err)
+		}
+		if err := update(provider); err != nil {
+			return err
+		}
+		if err := tx.Save(provider).Error; err != nil {
+			return fmt.Errorf("failed to update provider %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	provider.HasSecret = provider.Secret != ""
+	return provider, nil
+}
+
+func (r *providerrepository) DeleteProvider(name string) error {
+	result := r.db.Where("name = ?", name).Delete(&model.Provider{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete provider %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrProviderNotFound
+	}
+	return nil
+}
+
+// SeedProviders stores the given providers when the registry is empty, the first time the registry starts.
+// Once it holds providers, it is only changed through the admin API.
+func (r *providerrepository) SeedProviders(providers []model.Provider) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// replicas starting together seed once
+		if err := tx.Exec("LOCK TABLE providers IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return fmt.Errorf("failed to lock providers %w", err)
+		}
+		var count int64
+		if err := tx.Model(&model.Provider{}).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to count providers %w", err)
+		}
+		if count > 0 || len(providers) == 0 {
+			return nil
+		}
+		if err := tx.Create(&providers).Error; err != nil {
+			return fmt.Errorf("failed to seed providers %w", err)
+		}
+		return nil
+	})
+}
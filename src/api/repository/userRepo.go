@@ -2,53 +2,59 @@ package repository
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"strconv"
-	"sync"
 	"time"
 
-	"github.com/joho/godotenv"
 	model "github.com/myrachanto/entaingo/src/api/models"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
-// Userrepository repository
-var (
-	Userrepository UserrepoInterface = &userrepository{}
-	Userrepo                         = userrepository{}
-)
-
 type Key struct {
 	EncryptionKey string `mapstructure:"EncryptionKey"`
 }
 
 type UserrepoInterface interface {
 	Create(transaction *model.TransactionRequest) (*model.UserInfo, error)
-	CancelOddTransactions(ctx context.Context, wg *sync.WaitGroup)
-	GetTransactions(userId int) (*model.UserInfo, error)
+	CreateBatch(userId uint, atomic bool, items []model.BatchItem) (*model.BatchResult, error)
+	OddCancellationCandidates(limit int) ([]model.Transaction, error)
+	CancelTransaction(id uint, reason string, delta model.Money) (*model.UserInfo, error)
+	FindTransaction(transactionId string) (*model.Transaction, error)
+	SaveCancellationRun(run *model.CancellationRun) error
+	GetTransactions(filter *model.TransactionFilter) (*model.UserInfo, error)
+	ExportTransactions(ctx context.Context, filter *model.ExportFilter, fn func(row model.ExportRow) error) error
+	ReconcileUser(userId uint) (*model.LedgerCheck, error)
+	BalanceEvents(afterSeq uint64, userId uint, limit int) ([]model.BalanceEvent, error)
+	LastEventSeq() (uint64, error)
+	CreateUser(userReq *model.UserRequest) (*model.User, error)
+	OpenWallet(userId uint, currency string) (*model.Wallet, error)
+	GetUser(userId uint) (*model.User, error)
+	BalanceAt(userId uint, at time.Time) (*model.BalanceAsOf, error)
+	UpdateUserStatus(userId uint, status string) (*model.User, error)
+}
+type userrepository struct {
+	db *gorm.DB
 }
-type userrepository struct{}
 
-func NewUserRepo() UserrepoInterface {
-	return &userrepository{}
+// NewUserRepo builds the repository on the shared connection pool opened by IndexRepo.Dbsetup
+func NewUserRepo(db *gorm.DB) UserrepoInterface {
+	return &userrepository{
+		db,
+	}
 }
 func (r *userrepository) Create(transactionReq *model.TransactionRequest) (*model.UserInfo, error) {
-	// Get default user
-	defaultUser, err := r.GetUser()
-	if err != nil {
-		return nil, err
+	currency := model.NormalizeCurrency(transactionReq.Currency)
+	if !model.ValidCurrency(currency) {
+		return nil, ErrUnknownCurrency
+	}
+	if !transactionReq.Amount.FitsCurrency(currency) {
+		return nil, ErrAmountPrecision
 	}
 
 	// Connect to the database
-	gormdb, err := IndexRepo.Getconnected()
-	if err != nil {
-		return nil, err
-	}
-	defer IndexRepo.DbClose(gormdb)
+	gormdb := r.db
 
 	// Start transaction
 	tx := gormdb.Begin()
@@ -63,203 +69,663 @@ func (r *userrepository) Create(transactionReq *model.TransactionRequest) (*mode
 	// Check if transaction already exists
 	var existingTransaction model.Transaction
 	if err := tx.Where("transaction_id = ?", transactionReq.TransactionID).First(&existingTransaction).Error; err == nil {
-		// Transaction already processed
+		// Transaction already processed, replay it if the provider is retrying the same request
 		tx.Rollback()
-		return nil, fmt.Errorf("transaction already processed")
+		return r.replay(gormdb, existingTransaction, transactionReq, currency)
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 		// Some other error occurred
 		return nil, handleError(tx, err, "failed to check existing transaction")
 	}
 
-	// Lock the user row for update (optimistic locking)
+	// Lock the user row so the account can't be closed mid transaction
 	var user model.User
-	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, defaultUser.ID).Error; err != nil {
+	if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).First(&user, transactionReq.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			tx.Rollback()
+			return nil, ErrUnknownAccount
+		}
 		return nil, handleError(tx, err, "user not found")
 	}
+	if user.Status != model.UserStatusActive {
+		tx.Rollback()
+		return nil, ErrAccountInactive
+	}
+
+	transaction, err := applyTransaction(tx, user, transactionReq, currency)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrDuplicatedKey):
+			// a concurrent request stored the same transactionId first
+			tx.Rollback()
+			if err := gormdb.Where("transaction_id = ?", transactionReq.TransactionID).First(&existingTransaction).Error; err != nil {
+				return nil, fmt.Errorf("failed to load duplicate transaction %w", err)
+			}
+			return r.replay(gormdb, existingTransaction, transactionReq, currency)
+		case errors.Is(err, ErrNoWallet), errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrVersionConflict):
+			tx.Rollback()
+			return nil, err
+		}
+		return nil, handleError(tx, err, "failed to apply transaction")
+	}
+	if err := tx.Where("user_id = ?", user.ID).Order("currency").Find(&user.Wallets).Error; err != nil {
+		return nil, handleError(tx, err, "failed to load wallets")
+	}
+
+	// Commit the transaction, a failed commit stored nothing
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to commit transaction %w", err)
+	}
+
+	// Return user info and transaction details
+	return &model.UserInfo{
+		User:        user,
+		Transaction: []model.Transaction{*transaction},
+	}, nil
+}
+
+// applyTransaction moves the user's wallet by one transaction and stores it with its journal entry.
+// It runs inside tx, which must already hold a lock on the active user row;
+// the wallet row is locked here and updated against its version.
+func applyTransaction(tx *gorm.DB, user model.User, transactionReq *model.TransactionRequest, currency string) (*model.Transaction, error) {
+	// Lock the wallet row for update (optimistic locking)
+	var wallet model.Wallet
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND currency = ?", user.ID, currency).First(&wallet).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoWallet
+		}
+		return nil, fmt.Errorf("wallet not found %w", err)
+	}
 
 	// Update balance
-	newBalance := user.Balance
+	var delta model.Money
 	if transactionReq.State == "win" {
-		newBalance += transactionReq.Amount
+		delta = transactionReq.Amount
 	} else if transactionReq.State == "lost" {
-		newBalance -= transactionReq.Amount
-		if newBalance < 0 {
-			tx.Rollback()
-			return nil, fmt.Errorf("balance cannot be negative")
-		}
+		delta = -transactionReq.Amount
+	}
+	newBalance := wallet.Balance + delta
+	if newBalance < 0 {
+		return nil, ErrInsufficientFunds
 	}
 
 	// Optimistic lock based on version
-	if err := tx.Model(&user).Where("version = ?", user.Version).Updates(map[string]interface{}{
+	result := tx.Model(&wallet).Where("version = ?", wallet.Version).Updates(map[string]interface{}{
 		"balance": newBalance,
-		"version": user.Version + 1,
-	}).Error; err != nil {
-		return nil, handleError(tx, err, "failed to update balance, version conflict")
+		"version": wallet.Version + 1,
+	})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to update balance %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrVersionConflict
 	}
 
 	// Create transaction record
 	transaction := model.Transaction{
 		TransactionID: transactionReq.TransactionID,
 		Amount:        transactionReq.Amount,
+		Currency:      currency,
 		State:         transactionReq.State,
 		SourceType:    transactionReq.SourceType,
 		UserID:        user.ID,
 	}
 	if err := tx.Create(&transaction).Error; err != nil {
-		return nil, handleError(tx, err, "failed to save transaction")
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to save transaction %w", err)
 	}
+	if err := postEntry(tx, &transaction.ID, wallet, transaction.State, delta, newBalance); err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
 
-	// Commit the transaction
-	tx.Commit()
-
-	// Return user info and transaction details
+// replay answers a retried transactionId with the stored result,
+// or ErrTransactionConflict when the retry doesn't match what was stored
+func (r *userrepository) replay(gormdb *gorm.DB, existing model.Transaction, transactionReq *model.TransactionRequest, currency string) (*model.UserInfo, error) {
+	if !sameTransaction(existing, transactionReq, currency) {
+		return nil, ErrTransactionConflict
+	}
+	var user model.User
+	if err := gormdb.Preload("Wallets", func(db *gorm.DB) *gorm.DB {
+		return db.Order("currency")
+	}).First(&user, existing.UserID).Error; err != nil {
+		return nil, fmt.Errorf("user not found %w", err)
+	}
 	return &model.UserInfo{
 		User:        user,
-		Transaction: []model.Transaction{transaction},
+		Transaction: []model.Transaction{existing},
+		Replayed:    true,
 	}, nil
 }
 
-func handleError(tx *gorm.DB, err error, msg string) error {
+// sameTransaction reports whether a retried request carries the payload that was stored
+func sameTransaction(existing model.Transaction, transactionReq *model.TransactionRequest, currency string) bool {
+	return existing.UserID == transactionReq.UserID &&
+		existing.Amount == transactionReq.Amount &&
+		existing.Currency == currency &&
+		existing.State == transactionReq.State &&
+		existing.SourceType == transactionReq.SourceType
+}
+
+// CreateBatch applies a user's transactions in order under one lock on the user row.
+// Each item is applied exactly as Create applies a single transaction, behind its own savepoint.
+// An atomic batch rolls back as a whole at its first failing item; a best-effort batch
+// rolls back only the failing item and carries on. Retried transactionIds count as duplicates, not failures.
+func (r *userrepository) CreateBatch(userId uint, atomic bool, items []model.BatchItem) (*model.BatchResult, error) {
+	result := &model.BatchResult{
+		Mode:  model.BatchBestEffort,
+		Items: make([]model.BatchItemResult, 0, len(items)),
+	}
+	if atomic {
+		result.Mode = model.BatchAtomic
+	}
+	// errBatchFailed rolls an atomic batch back once its failing item is recorded
+	errBatchFailed := errors.New("atomic batch failed")
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the user row once for the whole batch so the account can't be closed midway
+		if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).First(&result.User, userId).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUnknownAccount
+			}
+			return fmt.Errorf("user not found %w", err)
+		}
+		if result.User.Status != model.UserStatusActive {
+			return ErrAccountInactive
+		}
+
+		for _, item := range items {
+			itemResult, err := applyBatchItem(tx, result.User, item)
+			if err != nil {
+				return err
+			}
+			result.Items = append(result.Items, itemResult)
+			if atomic && itemResult.Status != model.BatchItemApplied && itemResult.Status != model.BatchItemDuplicate {
+				return errBatchFailed
+			}
+		}
+		return tx.Where("user_id = ?", userId).Order("currency").Find(&result.User.Wallets).Error
+	})
+	if errors.Is(err, errBatchFailed) {
+		// report the whole batch, the items before the failure were rolled back with it
+		// except duplicates of transactions stored before the batch, which are still there
+		rolledBack := map[string]bool{}
+		for i := range result.Items[:len(result.Items)-1] {
+			item := &result.Items[i]
+			if item.Status == model.BatchItemApplied {
+				rolledBack[item.TransactionID] = true
+			} else if !rolledBack[item.TransactionID] {
+				continue
+			}
+			item.Status = model.BatchItemNotApplied
+			item.Transaction = nil
+		}
+		for _, item := range items[len(result.Items):] {
+			result.Items = append(result.Items, model.BatchItemResult{
+				Index:         item.Index,
+				TransactionID: item.Request.TransactionID,
+				Status:        model.BatchItemNotApplied,
+			})
+		}
+		if err := r.db.Where("user_id = ?", userId).Order("currency").Find(&result.User.Wallets).Error; err != nil {
+			return nil, fmt.Errorf("failed to load wallets %w", err)
+		}
+		return result, nil
+	}
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf(msg, err)
+		return nil, err
 	}
-	return nil
+	result.Committed = true
+	return result, nil
 }
 
-func (r *userrepository) CancelOddTransactions(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
-	log.Println("CancelOddTransactions started ....")
+// applyBatchItem applies one batch item behind a savepoint, rolling back to it when the item fails.
+// Item failures are reported in the result; the error is for failures that abort the whole batch.
+func applyBatchItem(tx *gorm.DB, user model.User, item model.BatchItem) (model.BatchItemResult, error) {
+	itemResult := model.BatchItemResult{
+		Index:         item.Index,
+		TransactionID: item.Request.TransactionID,
+	}
+	invalid := func(reason string) (model.BatchItemResult, error) {
+		itemResult.Status = model.BatchItemInvalid
+		itemResult.Error = reason
+		return itemResult, nil
+	}
+	if item.Invalid != "" {
+		return invalid(item.Invalid)
+	}
+	transactionReq := item.Request
+	currency := model.NormalizeCurrency(transactionReq.Currency)
+	if !model.ValidCurrency(currency) {
+		return invalid(ErrUnknownCurrency.Error())
+	}
+	if !transactionReq.Amount.FitsCurrency(currency) {
+		return invalid(ErrAmountPrecision.Error())
+	}
 
-	// Load environment variables
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file in routes ", err)
+	// the batch may repeat a transactionId, or retry one stored before
+	var existing model.Transaction
+	err := tx.Where("transaction_id = ?", transactionReq.TransactionID).First(&existing).Error
+	if err == nil {
+		if !sameTransaction(existing, &transactionReq, currency) {
+			return invalid(ErrTransactionConflict.Error())
+		}
+		itemResult.Status = model.BatchItemDuplicate
+		itemResult.Transaction = &existing
+		return itemResult, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return itemResult, fmt.Errorf("failed to check existing transaction %w", err)
 	}
 
-	OddCancelInterval := os.Getenv("OddCancelInterval")
-	OddInterval, err := strconv.ParseUint(OddCancelInterval, 10, 32)
-	if err != nil {
-		log.Fatal("failed to parse the odd Interval ", err)
+	savepoint := fmt.Sprintf("batch_item_%d", item.Index)
+	if err := tx.SavePoint(savepoint).Error; err != nil {
+		return itemResult, fmt.Errorf("failed to set savepoint %w", err)
 	}
+	transaction, err := applyTransaction(tx, user, &transactionReq, currency)
+	if err == nil {
+		itemResult.Status = model.BatchItemApplied
+		itemResult.Transaction = transaction
+		return itemResult, nil
+	}
+	if err := tx.RollbackTo(savepoint).Error; err != nil {
+		return itemResult, fmt.Errorf("failed to roll back to savepoint %w", err)
+	}
+	switch {
+	case errors.Is(err, ErrInsufficientFunds):
+		itemResult.Status = model.BatchItemInsufficientFunds
+		itemResult.Error = err.Error()
+		return itemResult, nil
+	case errors.Is(err, ErrNoWallet):
+		return invalid(err.Error())
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		// a concurrent request stored the same transactionId first
+		if err := tx.Where("transaction_id = ?", transactionReq.TransactionID).First(&existing).Error; err != nil {
+			return itemResult, fmt.Errorf("failed to load duplicate transaction %w", err)
+		}
+		if !sameTransaction(existing, &transactionReq, currency) {
+			return invalid(ErrTransactionConflict.Error())
+		}
+		itemResult.Status = model.BatchItemDuplicate
+		itemResult.Transaction = &existing
+		return itemResult, nil
+	}
+	return itemResult, err
+}
 
-	gormdb, err := IndexRepo.Getconnected()
+func handleError(tx *gorm.DB, err error, msg string) error {
 	if err != nil {
-		log.Fatal("failed to connect to the database ", err)
+		tx.Rollback()
+		return fmt.Errorf("%s %w", msg, err)
 	}
-	defer IndexRepo.DbClose(gormdb)
-
-	ticker := time.NewTicker(time.Minute * time.Duration(OddInterval))
-	defer ticker.Stop()
+	return nil
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			log.Println("N odd time cancellation initialized")
+// OddCancellationCandidates selects the latest odd transactions that haven't been canceled
+func (r *userrepository) OddCancellationCandidates(limit int) ([]model.Transaction, error) {
+	transactions := []model.Transaction{}
+	if err := r.db.Where("id % 2 != 0 AND canceled = ?", false).
+		Order("processed_at desc").
+		Limit(limit).
+		Find(&transactions).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch transactions %w", err)
+	}
+	return transactions, nil
+}
 
-			// Select 10 latest odd transactions that haven't been canceled
-			var transactions []model.Transaction
-			if err := gormdb.Where("id % 2 != 0 AND canceled = ?", false).
-				Order("processed_at desc").
-				Limit(10).
-				Find(&transactions).Error; err != nil {
-				log.Println("Error fetching transactions: ", err)
-				continue
+// CancelTransaction applies delta to the transaction's wallet, marks the transaction canceled with reason
+// and journals the reversal in one database transaction. It returns the user with updated wallets.
+func (r *userrepository) CancelTransaction(id uint, reason string, delta model.Money) (*model.UserInfo, error) {
+	var current model.Transaction
+	var user model.User
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// re-read under lock, the transaction may have been canceled since it was selected
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrTransactionNotFound
 			}
+			return fmt.Errorf("failed to lock transaction %w", err)
+		}
+		if current.Canceled {
+			return ErrAlreadyCanceled
+		}
 
-			// Use a transaction to cancel and update user balances in one batch
-			tx := gormdb.Begin()
-
-			for _, transaction := range transactions {
-				var user model.User
-				if err := tx.First(&user, transaction.UserID).Error; err != nil {
-					tx.Rollback()
-					log.Println("Failed to fetch user for transaction: ", err)
-					continue
-				}
-
-				// Reverse balance impact
-				if transaction.State == "win" {
-					user.Balance -= transaction.Amount
-				} else if transaction.State == "lost" {
-					user.Balance += transaction.Amount
-				}
-
-				// Prevent negative balances
-				if user.Balance < 0 {
-					tx.Rollback()
-					log.Println("Balance would be negative, skipping")
-					continue
-				}
-
-				// Update user balance
-				if err := tx.Save(&user).Error; err != nil {
-					tx.Rollback()
-					log.Println("Failed to update user balance: ", err)
-					continue
-				}
-
-				// Mark transaction as canceled
-				transaction.Canceled = true
-				if err := tx.Save(&transaction).Error; err != nil {
-					tx.Rollback()
-					log.Println("Failed to cancel transaction: ", err)
-					continue
-				}
-			}
+		var wallet model.Wallet
+		if err := tx.Where("user_id = ? AND currency = ?", current.UserID, current.Currency).First(&wallet).Error; err != nil {
+			return fmt.Errorf("failed to fetch wallet for transaction %w", err)
+		}
 
-			// Commit the transaction
-			tx.Commit()
+		// Prevent negative balances
+		newBalance := wallet.Balance + delta
+		if newBalance < 0 {
+			return ErrInsufficientFunds
+		}
 
-		case <-ctx.Done():
-			log.Println("CancelOddTransactions gracefully shutting down...")
-			return
+		// Optimistic lock based on version
+		result := tx.Model(&wallet).Where("version = ?", wallet.Version).Updates(map[string]interface{}{
+			"balance": newBalance,
+			"version": wallet.Version + 1,
+		})
+		if result.Error != nil {
+			return fmt.Errorf("failed to update wallet balance %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrVersionConflict
 		}
-	}
-}
 
-func (r userrepository) GetTransactions(userId int) (*model.UserInfo, error) {
-	gorm, err := IndexRepo.Getconnected()
+		// Mark transaction as canceled
+		if err := tx.Model(&current).Updates(map[string]interface{}{
+			"canceled":      true,
+			"canceled_at":   time.Now(),
+			"cancel_reason": reason,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to cancel transaction %w", err)
+		}
+		if err := postEntry(tx, &current.ID, wallet, model.EntryCancel, delta, newBalance); err != nil {
+			return err
+		}
+		return tx.Preload("Wallets", func(db *gorm.DB) *gorm.DB {
+			return db.Order("currency")
+		}).First(&user, current.UserID).Error
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer IndexRepo.DbClose(gorm)
-	results := []model.Transaction{}
-	errs := gorm.Find(&results).Error
-	if errs != nil {
-		return nil, fmt.Errorf("no results found %w", errs)
+	return &model.UserInfo{
+		User:        user,
+		Transaction: []model.Transaction{current},
+	}, nil
+}
+
+// FindTransaction looks a transaction up by the provider's transactionId
+func (r *userrepository) FindTransaction(transactionId string) (*model.Transaction, error) {
+	transaction := &model.Transaction{}
+	err := r.db.Where("transaction_id = ?", transactionId).First(transaction).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find transaction %w", err)
 	}
+	return transaction, nil
+}
+
+func (r *userrepository) SaveCancellationRun(run *model.CancellationRun) error {
+	return saveCancellationRun(r.db, run)
+}
+
+// GetTransactions lists one page of a user's transactions, newest first.
+// Pages are keyed on (processed_at, id) rather than offsets, so reading deep pages stays cheap
+// and rows inserted meanwhile don't shift later pages.
+func (r userrepository) GetTransactions(filter *model.TransactionFilter) (*model.UserInfo, error) {
+	gormdb := r.db
 	var user model.User
-	errs = gorm.Where("id = ?", userId).First(&user).Error
-	if errs != nil {
-		return nil, fmt.Errorf("no results found %w", errs)
+	if err := gormdb.Preload("Wallets", func(db *gorm.DB) *gorm.DB {
+		return db.Order("currency")
+	}).First(&user, filter.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUnknownAccount
+		}
+		return nil, fmt.Errorf("failed to fetch user %w", err)
 	}
-	return &model.UserInfo{
+
+	query := gormdb.Where("user_id = ?", filter.UserID)
+	if filter.State != "" {
+		query = query.Where("state = ?", filter.State)
+	}
+	if filter.SourceType != "" {
+		query = query.Where("source_type = ?", filter.SourceType)
+	}
+	if filter.Canceled != nil {
+		query = query.Where("canceled = ?", *filter.Canceled)
+	}
+	if filter.From != nil {
+		query = query.Where("processed_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("processed_at < ?", *filter.To)
+	}
+	if filter.After != nil {
+		query = query.Where("(processed_at, id) < (?, ?)", filter.After.ProcessedAt, filter.After.ID)
+	}
+
+	// read one extra row to know whether another page follows
+	results := []model.Transaction{}
+	if err := query.Order("processed_at DESC, id DESC").Limit(filter.Limit + 1).Find(&results).Error; err != nil {
+		return nil, fmt.Errorf("failed to list transactions %w", err)
+	}
+	userInfo := &model.UserInfo{
 		User:        user,
 		Transaction: results,
-	}, nil
+	}
+	if len(results) > filter.Limit {
+		userInfo.Transaction = results[:filter.Limit]
+		userInfo.NextCursor = model.CursorAfter(results[filter.Limit-1]).Encode()
+	}
+	return userInfo, nil
 }
-func (r userrepository) GetUser() (*model.User, error) {
-	gorm, err := IndexRepo.Getconnected()
+
+// ExportTransactions streams the transactions of a date range to fn in processed order, one row at a time.
+// The running balance is worked out by the database from each wallet's current balance,
+// so no more than one row is held in memory however large the range.
+func (r userrepository) ExportTransactions(ctx context.Context, filter *model.ExportFilter, fn func(row model.ExportRow) error) error {
+	gormdb := r.db.WithContext(ctx)
+	laterUser, rowUser := "", ""
+	args := map[string]interface{}{"from": filter.From, "to": filter.To}
+	if filter.UserID != 0 {
+		laterUser, rowUser = "AND user_id = @user", "AND t.user_id = @user"
+		args["user"] = filter.UserID
+	}
+	// a wallet's balance before the range is its balance now less every later transaction still in effect
+	rows, err := gormdb.Raw(`WITH later AS (
+			SELECT user_id, currency, SUM(CASE state WHEN 'win' THEN amount ELSE -amount END) AS total
+			FROM transactions
+			WHERE NOT canceled AND processed_at >= @from `+laterUser+`
+			GROUP BY user_id, currency
+		)
+		SELECT t.*, w.balance - COALESCE(l.total, 0) + SUM(
+				CASE WHEN t.canceled THEN 0 WHEN t.state = 'win' THEN t.amount ELSE -t.amount END
+			) OVER (PARTITION BY t.user_id, t.currency ORDER BY t.processed_at, t.id) AS running_balance
+		FROM transactions t
+		JOIN wallets w ON w.user_id = t.user_id AND w.currency = t.currency
+		LEFT JOIN later l ON l.user_id = t.user_id AND l.currency = t.currency
+		WHERE t.processed_at >= @from AND t.processed_at < @to `+rowUser+`
+		ORDER BY t.processed_at, t.id`, args).Rows()
+	if err != nil {
+		return fmt.Errorf("failed to export transactions %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row model.ExportRow
+		if err := gormdb.ScanRows(rows, &row); err != nil {
+			return fmt.Errorf("failed to read exported transaction %w", err)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to export transactions %w", err)
+	}
+	return nil
+}
+
+func (r userrepository) CreateUser(userReq *model.UserRequest) (*model.User, error) {
+	currencies := userReq.Currencies
+	if len(currencies) == 0 {
+		currencies = []string{DefaultCurrency()}
+	}
+	user := &model.User{
+		Status: model.UserStatusActive,
+	}
+	seen := map[string]bool{}
+	for _, code := range currencies {
+		currency := model.NormalizeCurrency(code)
+		if !model.ValidCurrency(currency) {
+			return nil, ErrUnknownCurrency
+		}
+		if seen[currency] {
+			continue
+		}
+		seen[currency] = true
+		user.Wallets = append(user.Wallets, model.Wallet{Currency: currency})
+	}
+
+	gormdb := r.db
+	// default transactions are skipped, so save the user and its wallets atomically
+	if err := gormdb.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(user).Error
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create user %w", err)
+	}
+	return user, nil
+}
+
+// OpenWallet adds a zero balance wallet in currency to an active user
+func (r userrepository) OpenWallet(userId uint, currency string) (*model.Wallet, error) {
+	currency = model.NormalizeCurrency(currency)
+	if !model.ValidCurrency(currency) {
+		return nil, ErrUnknownCurrency
+	}
+	user, err := r.GetUser(userId)
 	if err != nil {
 		return nil, err
 	}
-	defer IndexRepo.DbClose(gorm)
+	if user.Status != model.UserStatusActive {
+		return nil, ErrAccountInactive
+	}
+	for _, wallet := range user.Wallets {
+		if wallet.Currency == currency {
+			return nil, ErrWalletExists
+		}
+	}
+
+	gormdb := r.db
+	wallet := &model.Wallet{
+		UserID:   userId,
+		Currency: currency,
+	}
+	if err := gormdb.Create(wallet).Error; err != nil {
+		if uniqueViolation(err) {
+			// a concurrent request opened the same currency first
+			return nil, ErrWalletExists
+		}
+		return nil, fmt.Errorf("failed to open wallet %w", err)
+	}
+	return wallet, nil
+}
+func (r userrepository) GetUser(userId uint) (*model.User, error) {
+	gormdb := r.db
 	result := &model.User{}
-	errs := gorm.First(&result).Error
+	errs := gormdb.Preload("Wallets", func(db *gorm.DB) *gorm.DB {
+		return db.Order("currency")
+	}).First(result, userId).Error
+	if errors.Is(errs, gorm.ErrRecordNotFound) {
+		return nil, ErrUnknownAccount
+	}
 	if errs != nil {
 		return nil, fmt.Errorf("user not found %w", errs)
 	}
-	return result, err
+	return result, nil
 }
 
-func (r userrepository) transactionIdExist(transactionId string) bool {
-	gorm, err := IndexRepo.Getconnected()
+// BalanceAt works a user's wallet balances back to the instant at: from the current balance it takes off
+// every transaction processed after at and undoes every cancellation made after at.
+// Cancellations count at canceled_at, not at the processed_at of the transaction they reverse.
+// One without a canceled_at counts at processed_at, as if its transaction never moved the balance.
+func (r userrepository) BalanceAt(userId uint, at time.Time) (*model.BalanceAsOf, error) {
+	result := &model.BalanceAsOf{
+		UserID:  userId,
+		At:      at,
+		Wallets: []model.WalletBalance{},
+	}
+	// one snapshot, so a transaction committing meanwhile can't count in the balance but not in the rollback
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var user model.User
+		if err := tx.Preload("Wallets", func(db *gorm.DB) *gorm.DB {
+			return db.Order("currency")
+		}).First(&user, userId).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUnknownAccount
+			}
+			return fmt.Errorf("failed to fetch user %w", err)
+		}
+
+		var later []struct {
+			Currency string
+			Amount   model.Money
+		}
+		if err := tx.Raw(`SELECT currency, COALESCE(SUM(
+				CASE WHEN processed_at > @at THEN CASE state WHEN 'win' THEN amount ELSE -amount END ELSE 0 END +
+				CASE WHEN canceled AND COALESCE(canceled_at, processed_at) > @at THEN CASE state WHEN 'win' THEN -amount ELSE amount END ELSE 0 END
+			), 0) AS amount
+			FROM transactions
+			WHERE user_id = @user AND (processed_at > @at OR canceled_at > @at)
+			GROUP BY currency`,
+			map[string]interface{}{"user": userId, "at": at}).Scan(&later).Error; err != nil {
+			return fmt.Errorf("failed to sum later transactions %w", err)
+		}
+		changes := map[string]model.Money{}
+		for _, change := range later {
+			changes[change.Currency] = change.Amount
+		}
+		for _, wallet := range user.Wallets {
+			result.Wallets = append(result.Wallets, model.WalletBalance{
+				Currency: wallet.Currency,
+				Balance:  wallet.Balance - changes[wallet.Currency],
+			})
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
-		return false
+		return nil, err
+	}
+	return result, nil
+}
+
+// backfillCanceledAt dates the cancellations made before canceled_at was recorded, by the journal entry
+// that reversed them when there is one, else by the processed_at of the transaction
+func backfillCanceledAt(db *gorm.DB) error {
+	if err := db.Exec(`UPDATE transactions SET canceled_at = COALESCE(
+			(SELECT MIN(created_at) FROM journal_entries WHERE journal_entries.transaction_id = transactions.id AND kind = ?),
+			processed_at)
+		WHERE canceled AND canceled_at IS NULL`, model.EntryCancel).Error; err != nil {
+		return fmt.Errorf("failed to backfill canceled_at %w", err)
+	}
+	return nil
+}
+
+// UpdateUserStatus moves an account between active and suspended, or closes it for good
+func (r userrepository) UpdateUserStatus(userId uint, status string) (*model.User, error) {
+	if !model.ValidUserStatus(status) {
+		return nil, ErrInvalidStatus
+	}
+	gormdb := r.db
+
+	tx := gormdb.Begin()
+	var user model.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			tx.Rollback()
+			return nil, ErrUnknownAccount
+		}
+		return nil, handleError(tx, err, "user not found")
+	}
+	if user.Status == model.UserStatusClosed && status != model.UserStatusClosed {
+		tx.Rollback()
+		return nil, ErrAccountClosed
+	}
+	if err := tx.Model(&user).Where("version = ?", user.Version).Updates(map[string]interface{}{
+		"status":  status,
+		"version": user.Version + 1,
+	}).Error; err != nil {
+		return nil, handleError(tx, err, "failed to update status")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update status %w", err)
 	}
-	defer IndexRepo.DbClose(gorm)
-	result := &model.Transaction{}
-	errs := gorm.Where("transaction_id = ?", transactionId).First(&result).Error
-	return errs == nil
+	return &user, nil
 }
@@ -0,0 +1,302 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	model "github.com/myrachanto/entaingo/src/api/models"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// newMockRepo runs a user repository against a mocked postgres connection, configured as Dbsetup configures the real one
+func newMockRepo(t *testing.T) (*userrepository, sqlmock.Sqlmock) {
+	conn, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{
+		SkipDefaultTransaction: true,
+		TranslateError:         true,
+	})
+	assert.NoError(t, err)
+	return &userrepository{db: db}, mock
+}
+
+func TestOpenWalletRace(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	mock.ExpectQuery(`SELECT \* FROM "users"`).WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "version"}).AddRow(7, "active", 1))
+	mock.ExpectQuery(`SELECT \* FROM "wallets"`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "version"}).AddRow(1, 7, "USD", "0.000", 1))
+	// a concurrent request inserts the EUR wallet between the check and the insert
+	mock.ExpectQuery(`INSERT INTO "wallets"`).
+		WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "idx_wallet_user_currency"})
+
+	wallet, err := repo.OpenWallet(7, "eur")
+	assert.Nil(t, wallet)
+	assert.ErrorIs(t, err, ErrWalletExists)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// recently matches a timestamp written in the last minute
+type recently struct{}
+
+func (recently) Match(v driver.Value) bool {
+	at, ok := v.(time.Time)
+	return ok && time.Since(at) >= 0 && time.Since(at) < time.Minute
+}
+
+func TestCancelTransactionRecordsWhenAndWhy(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "transactions" .* FOR UPDATE`).WithArgs(42, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "transaction_id", "amount", "currency", "state", "source_type", "user_id", "canceled"}).
+			AddRow(42, "tx_42", "10.000", "USD", "win", "game", 7, false))
+	mock.ExpectQuery(`SELECT \* FROM "wallets"`).WithArgs(7, "USD", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "version"}).AddRow(3, 7, "USD", "25.000", 4))
+	mock.ExpectExec(`UPDATE "wallets" SET "balance"=\$1,"version"=\$2 WHERE version = \$3`).WithArgs("15.000", 5, 4, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE "transactions" SET "cancel_reason"=\$1,"canceled"=\$2,"canceled_at"=\$3 WHERE "id" = \$4`).
+		WithArgs(model.CancelReasonOddJob, true, recently{}, 42).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO "journal_entries"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	// the wallet posting records the balance it leaves
+	mock.ExpectQuery(`INSERT INTO "postings" \("entry_id","account","currency","amount","balance_after","created_at"\)`).
+		WithArgs(9, "wallet:3", "USD", "-10.000", "15.000", sqlmock.AnyArg(), 9, "house:USD", "USD", "10.000", nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(17).AddRow(18))
+	mock.ExpectQuery(`SELECT \* FROM "users"`).WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "version"}).AddRow(7, "active", 2))
+	mock.ExpectQuery(`SELECT \* FROM "wallets"`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "version"}).AddRow(3, 7, "USD", "15.000", 5))
+	mock.ExpectCommit()
+
+	info, err := repo.CancelTransaction(42, model.CancelReasonOddJob, -10000)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	if !assert.NoError(t, err) {
+		return
+	}
+	canceled := info.Transaction[0]
+	assert.True(t, canceled.Canceled)
+	assert.Equal(t, model.CancelReasonOddJob, canceled.CancelReason)
+	if assert.NotNil(t, canceled.CanceledAt) {
+		assert.WithinDuration(t, time.Now(), *canceled.CanceledAt, time.Minute)
+	}
+}
+
+func TestBackfillCanceledAt(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	mock.ExpectExec(`UPDATE transactions SET canceled_at = COALESCE\(\s*\(SELECT MIN\(created_at\) FROM journal_entries .* kind = \$1\),\s*processed_at\)\s*WHERE canceled AND canceled_at IS NULL`).
+		WithArgs(model.EntryCancel).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	assert.NoError(t, backfillCanceledAt(repo.db))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBackfillBalanceAfter(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	mock.ExpectExec(`UPDATE postings SET balance_after = running.balance\s+FROM \(SELECT id, SUM\(amount\) OVER \(PARTITION BY account ORDER BY entry_id, id\) AS balance\s+FROM postings WHERE account LIKE 'wallet:%'\) AS running\s+WHERE postings.id = running.id AND postings.balance_after IS NULL`).
+		WillReturnResult(sqlmock.NewResult(0, 12))
+
+	assert.NoError(t, backfillBalanceAfter(repo.db))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBalanceAtLegacyCancellation(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	at := time.Date(2024, 10, 22, 12, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "users"`).WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "version"}).AddRow(7, "active", 3))
+	mock.ExpectQuery(`SELECT \* FROM "wallets"`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "version"}).AddRow(3, 7, "USD", "15.000", 3))
+	// since at: a win of 5, and a win of 10 canceled before canceled_at was recorded, which nets to nothing
+	// as long as its NULL canceled_at falls back to processed_at
+	mock.ExpectQuery(`CASE WHEN canceled AND COALESCE\(canceled_at, processed_at\) > \$\d+ THEN`).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "amount"}).AddRow("USD", "5.000"))
+	mock.ExpectCommit()
+
+	balance, err := repo.BalanceAt(7, at)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []model.WalletBalance{{Currency: "USD", Balance: 10000}}, balance.Wallets)
+	}
+}
+
+func TestBalanceEventsFromTheJournal(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	mock.ExpectQuery(`SELECT journal_entries.id AS seq, .* postings.balance_after AS balance, .* FROM "journal_entries" JOIN postings .* JOIN wallets .* WHERE \(journal_entries.id > \$1 AND journal_entries.transaction_id IS NOT NULL\) AND wallets.user_id = \$2 ORDER BY journal_entries.id LIMIT \$3`).
+		WithArgs(40, 7, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "kind", "user_id", "currency", "balance", "transaction_id"}).
+			AddRow(41, model.EntryWin, 7, "USD", "35.000", 12).
+			AddRow(44, model.EntryCancel, 7, "USD", "25.000", 12))
+	mock.ExpectQuery(`SELECT \* FROM "transactions" WHERE id IN \(\$1\)`).WithArgs(12).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "transaction_id", "user_id", "currency"}).AddRow(12, "tx_12", 7, "USD"))
+
+	events, err := repo.BalanceEvents(40, 7, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, uint64(41), events[0].Seq)
+		assert.Equal(t, model.BalanceEventTransaction, events[0].Kind)
+		assert.Equal(t, model.Money(35000), events[0].Balance)
+		assert.Equal(t, model.BalanceEventCancellation, events[1].Kind)
+		assert.Equal(t, "tx_12", events[1].Transaction.TransactionID)
+	}
+}
+
+// batchItem is a transaction of amount on the USD wallet of user 7
+func batchItem(index int, transactionId string, state string, amount model.Money) model.BatchItem {
+	return model.BatchItem{Index: index, Request: model.TransactionRequest{
+		State: state, Amount: amount, Currency: "USD", TransactionID: transactionId, SourceType: "game", UserID: 7,
+	}}
+}
+
+// expectBatchStart expects the lock on user 7 an atomic or best-effort batch starts with
+func expectBatchStart(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "users" .* FOR SHARE`).WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "version"}).AddRow(7, "active", 1))
+}
+
+// expectLookup expects the check for a stored transactionId, finding stored when it isn't empty
+func expectLookup(mock sqlmock.Sqlmock, transactionId string, stored ...driver.Value) {
+	rows := sqlmock.NewRows([]string{"id", "transaction_id", "amount", "currency", "state", "source_type", "user_id"})
+	if len(stored) > 0 {
+		rows.AddRow(stored...)
+	}
+	mock.ExpectQuery(`SELECT \* FROM "transactions" WHERE transaction_id = \$1`).WithArgs(transactionId, 1).WillReturnRows(rows)
+}
+
+// expectWallet expects the USD wallet of user 7 to be locked at balance and version
+func expectWallet(mock sqlmock.Sqlmock, balance string, version int) {
+	mock.ExpectQuery(`SELECT \* FROM "wallets" .* FOR UPDATE`).WithArgs(7, "USD", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "version"}).AddRow(3, 7, "USD", balance, version))
+}
+
+// expectApplied expects a transaction to be stored with its journal entry, moving the wallet to balance
+func expectApplied(mock sqlmock.Sqlmock, balance string, version int, id int) {
+	mock.ExpectExec(`UPDATE "wallets" SET "balance"=\$1,"version"=\$2 WHERE version = \$3`).WithArgs(balance, version+1, version, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO "transactions"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	mock.ExpectQuery(`INSERT INTO "journal_entries"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	mock.ExpectQuery(`INSERT INTO "postings"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2 * id).AddRow(2*id + 1))
+}
+
+// expectWallets expects the wallets of user 7 to be read back at balance
+func expectWallets(mock sqlmock.Sqlmock, balance string) {
+	mock.ExpectQuery(`SELECT \* FROM "wallets" WHERE user_id = \$1 ORDER BY currency`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "version"}).AddRow(3, 7, "USD", balance, 3))
+}
+
+func statuses(result *model.BatchResult) []string {
+	statuses := []string{}
+	for _, item := range result.Items {
+		statuses = append(statuses, item.Status)
+	}
+	return statuses
+}
+
+func TestCreateBatchBestEffort(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	expectBatchStart(mock)
+	// applied
+	expectLookup(mock, "tx1")
+	mock.ExpectExec(`SAVEPOINT batch_item_0`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectWallet(mock, "10.000", 1)
+	expectApplied(mock, "15.000", 1, 21)
+	// more than the balance, rolled back to its savepoint
+	expectLookup(mock, "tx2")
+	mock.ExpectExec(`SAVEPOINT batch_item_1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectWallet(mock, "15.000", 2)
+	mock.ExpectExec(`ROLLBACK TO SAVEPOINT batch_item_1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	// tx1 again, found as stored by the first item
+	expectLookup(mock, "tx1", 21, "tx1", "5.000", "USD", "win", "game", 7)
+	// stored by a concurrent request between the check and the insert
+	expectLookup(mock, "tx3")
+	mock.ExpectExec(`SAVEPOINT batch_item_3`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectWallet(mock, "15.000", 2)
+	mock.ExpectExec(`UPDATE "wallets"`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO "transactions"`).WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "idx_transaction_id"})
+	mock.ExpectExec(`ROLLBACK TO SAVEPOINT batch_item_3`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectLookup(mock, "tx3", 22, "tx3", "1.000", "USD", "win", "game", 7)
+	expectWallets(mock, "15.000")
+	mock.ExpectCommit()
+
+	result, err := repo.CreateBatch(7, false, []model.BatchItem{
+		batchItem(0, "tx1", "win", 5000),
+		batchItem(1, "tx2", "lost", 50000),
+		batchItem(2, "tx1", "win", 5000),
+		batchItem(3, "tx3", "win", 1000),
+	})
+	assert.NoError(t, mock.ExpectationsWereMet())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, result.Committed)
+	assert.Equal(t, []string{model.BatchItemApplied, model.BatchItemInsufficientFunds, model.BatchItemDuplicate, model.BatchItemDuplicate}, statuses(result))
+	assert.Equal(t, uint(21), result.Items[2].Transaction.ID)
+	assert.Equal(t, uint(22), result.Items[3].Transaction.ID)
+	assert.Equal(t, model.Money(15000), result.User.Wallets[0].Balance)
+}
+
+func TestCreateBatchAtomicRollback(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	expectBatchStart(mock)
+	// stored before the batch
+	expectLookup(mock, "tx0", 20, "tx0", "2.000", "USD", "win", "game", 7)
+	expectLookup(mock, "tx1")
+	mock.ExpectExec(`SAVEPOINT batch_item_1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectWallet(mock, "10.000", 1)
+	expectApplied(mock, "15.000", 1, 21)
+	// tx1 again, stored by the item before and rolled back with it
+	expectLookup(mock, "tx1", 21, "tx1", "5.000", "USD", "win", "game", 7)
+	expectLookup(mock, "tx2")
+	mock.ExpectExec(`SAVEPOINT batch_item_3`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectWallet(mock, "15.000", 2)
+	mock.ExpectExec(`ROLLBACK TO SAVEPOINT batch_item_3`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	expectWallets(mock, "10.000")
+
+	result, err := repo.CreateBatch(7, true, []model.BatchItem{
+		batchItem(0, "tx0", "win", 2000),
+		batchItem(1, "tx1", "win", 5000),
+		batchItem(2, "tx1", "win", 5000),
+		batchItem(3, "tx2", "lost", 50000),
+		batchItem(4, "tx4", "win", 1000),
+	})
+	assert.NoError(t, mock.ExpectationsWereMet())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, result.Committed)
+	assert.Equal(t, []string{model.BatchItemDuplicate, model.BatchItemNotApplied, model.BatchItemNotApplied, model.BatchItemInsufficientFunds, model.BatchItemNotApplied}, statuses(result))
+	if assert.NotNil(t, result.Items[0].Transaction, "a transaction stored before the batch outlives its rollback") {
+		assert.Equal(t, uint(20), result.Items[0].Transaction.ID)
+	}
+	assert.Nil(t, result.Items[1].Transaction)
+	assert.Nil(t, result.Items[2].Transaction)
+	assert.Equal(t, model.Money(10000), result.User.Wallets[0].Balance)
+}
+
+func TestCreateFailedCommit(t *testing.T) {
+	repo, mock := newMockRepo(t)
+	mock.ExpectBegin()
+	expectLookup(mock, "tx1")
+	mock.ExpectQuery(`SELECT \* FROM "users" .* FOR SHARE`).WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "version"}).AddRow(7, "active", 1))
+	expectWallet(mock, "10.000", 1)
+	expectApplied(mock, "15.000", 1, 21)
+	expectWallets(mock, "15.000")
+	mock.ExpectCommit().WillReturnError(&pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"})
+
+	item := batchItem(0, "tx1", "win", 5000)
+	info, err := repo.Create(&item.Request)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Nil(t, info, "nothing is reported as stored")
+	assert.Equal(t, ErrUnavailable, AsError(err))
+}
@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/myrachanto/entaingo/src/api/rpc/walletpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// authorizationKey is the metadata key of the bearer token, as in the HTTP Authorization header
+const authorizationKey = "authorization"
+
+// error codes of rejected tokens and calls over their rate, as in the HTTP API
+const (
+	codeUnauthenticated = "unauthenticated"
+	codeForbidden       = "forbidden"
+	codeRateLimited     = "rate_limited"
+)
+
+// ownerMethods read the account named in the user_id of their request, the others that aren't signed are for staff only
+var ownerMethods = map[string]bool{
+	walletpb.WalletService_GetTransactions_FullMethodName: true,
+	walletpb.WalletService_GetBalance_FullMethodName:      true,
+}
+
+// Caller is who a bearer token was issued to
+type Caller struct {
+	UserID uint // the account of a player, 0 for staff
+	Staff  bool
+}
+
+// TokenVerifier checks bearer tokens, the same ones the HTTP API accepts
+type TokenVerifier interface {
+	// VerifyCaller checks the signature and expiry of token and returns who it was issued to
+	VerifyCaller(token string) (Caller, error)
+}
+
+// ProviderLimiter holds providers to their rates
+type ProviderLimiter interface {
+	// AllowProvider takes a call from the provider's rate. Over it, it returns false and how long until the next call is allowed.
+	AllowProvider(provider string) (bool, time.Duration)
+}
+
+// owned is a request naming the account it reads
+type owned interface {
+	GetUserId() uint64
+}
+
+// Authenticated checks the bearer token in the authorization metadata of every call that isn't signed by
+// a provider, with the rules of the HTTP API: a player only reads their own account, and only staff cancel.
+func Authenticated(tokens TokenVerifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if signedMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		scheme, token, _ := strings.Cut(first(md, authorizationKey), " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return nil, withReason(codes.Unauthenticated, codeUnauthenticated, "missing bearer token")
+		}
+		caller, err := tokens.VerifyCaller(token)
+		if err != nil {
+			return nil, withReason(codes.Unauthenticated, codeUnauthenticated, "invalid token")
+		}
+		if !caller.Staff {
+			account, isOwned := req.(owned)
+			if !ownerMethods[info.FullMethod] || !isOwned || caller.UserID == 0 || account.GetUserId() != uint64(caller.UserID) {
+				return nil, withReason(codes.PermissionDenied, codeForbidden, "not allowed for this token")
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Throttled holds the provider of each signed call to its rate. It goes after Signed,
+// so calls merely claiming to be a provider can't use its rate up.
+func Throttled(limiter ProviderLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if from, ok := req.(sourced); ok && signedMethods[info.FullMethod] {
+			if allowed, wait := limiter.AllowProvider(from.GetSourceType()); !allowed {
+				return nil, rateLimited(wait)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// rateLimited rejects a call over its rate, telling the client when to retry in a RetryInfo detail
+func rateLimited(wait time.Duration) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	detailed, err := st.WithDetails(
+		&errdetails.ErrorInfo{Reason: codeRateLimited, Domain: errorDomain},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)},
+	)
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
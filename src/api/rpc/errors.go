@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is the domain of the ErrorInfo detail carrying an error code
+const errorDomain = "entaingo"
+
+// error codes of failures caught before reaching the service, as in the HTTP API
+const (
+	codeInvalidRequest = "invalid_request"
+	codeInternal       = "internal_error"
+)
+
+// kindCode is the status code of each kind of domain error, the gRPC
+// counterpart of the HTTP status the same error gets from the HTTP API
+var kindCode = map[repository.Kind]codes.Code{
+	repository.KindNotFound:      codes.NotFound,
+	repository.KindInvalid:       codes.InvalidArgument,
+	repository.KindConflict:      codes.Aborted,
+	repository.KindUnprocessable: codes.FailedPrecondition,
+	repository.KindUnavailable:   codes.Unavailable,
+}
+
+// statusError converts err to a status carrying its error code as an ErrorInfo reason.
+// Errors that aren't domain errors are Internal.
+func statusError(err error) error {
+	domainErr := repository.AsError(err)
+	if domainErr == nil {
+		return withReason(codes.Internal, codeInternal, err.Error())
+	}
+	code, ok := kindCode[domainErr.Kind]
+	if !ok {
+		code = codes.Internal
+	}
+	// a reused transactionId is a conflict with a stored resource rather than with its state
+	if domainErr == repository.ErrTransactionConflict {
+		code = codes.AlreadyExists
+	}
+	return withReason(code, domainErr.Code, domainErr.Error())
+}
+
+// invalidArgument rejects a request that fails before reaching the service
+func invalidArgument(message string) error {
+	return withReason(codes.InvalidArgument, codeInvalidRequest, message)
+}
+
+// protoFields renames the JSON field names of validation errors to their proto names
+var protoFields = map[string]string{
+	"transactionId": "transaction_id",
+}
+
+// invalidFields rejects a request whose fields failed validation, listing them as BadRequest field violations
+func invalidFields(fields ...models.FieldError) error {
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(fields))
+	for i, field := range fields {
+		name := field.Field
+		if proto, ok := protoFields[name]; ok {
+			name = proto
+		}
+		violations[i] = &errdetails.BadRequest_FieldViolation{Field: name, Description: field.Message}
+	}
+	st := status.New(codes.InvalidArgument, "invalid request")
+	detailed, err := st.WithDetails(
+		&errdetails.ErrorInfo{Reason: codeInvalidRequest, Domain: errorDomain},
+		&errdetails.BadRequest{FieldViolations: violations},
+	)
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func withReason(code codes.Code, reason, message string) error {
+	st := status.New(code, message)
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
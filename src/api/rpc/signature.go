@@ -0,0 +1,179 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/rpc/walletpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// metadata keys of a signed call, the gRPC counterparts of the HTTP signature headers
+const (
+	SignatureKey = "x-signature" // hex HMAC-SHA256 of the canonical call, see canonicalCall
+	TimestampKey = "x-timestamp" // unix seconds the call was signed at
+	NonceKey     = "x-nonce"     // unique per call of a provider
+)
+
+// maxNonceLength caps a nonce to the width of its column
+const maxNonceLength = 128
+
+// error codes of rejected signatures, as in the HTTP API
+const (
+	codeInvalidSignature = "invalid_signature"
+	codeStaleRequest     = "stale_request"
+	codeReplayedRequest  = "replayed_request"
+)
+
+// signedMethods move money and must be signed by the provider named in their source_type
+var signedMethods = map[string]bool{
+	walletpb.WalletService_CreateTransaction_FullMethodName: true,
+}
+
+// SecretStore holds the shared secrets providers sign calls with, the same ones they sign HTTP requests with
+type SecretStore interface {
+	// Secrets returns the active secrets of provider, the current one first
+	Secrets(provider string) ([]string, error)
+}
+
+// sourced is a request naming the provider it comes from
+type sourced interface {
+	GetSourceType() string
+}
+
+// Sign is the signature a provider sends in x-signature for a call of method with req,
+// signed at timestamp with nonce
+func Sign(secret, method, timestamp, nonce string, req proto.Message) (string, error) {
+	payload, err := canonicalCall(method, timestamp, nonce, req)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// canonicalCall is what a signature covers, one field per line:
+//
+//	<full method>\n<x-timestamp>\n<x-nonce>\n<request>
+//
+// The full method is e.g. /entaingo.wallet.v1.WalletService/CreateTransaction and the request is the
+// message in the protobuf wire format, marshaled deterministically. The provider is the source_type
+// of the message, so it is covered along with the account and the amount.
+func canonicalCall(method, timestamp, nonce string, req proto.Message) ([]byte, error) {
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, field := range []string{method, timestamp, nonce} {
+		b.WriteString(field)
+		b.WriteByte('\n')
+	}
+	b.Write(body)
+	return b.Bytes(), nil
+}
+
+// Signed rejects calls to signedMethods that aren't signed with an active secret of the provider in their
+// source_type, were signed more than window away from now, or reuse a nonce, the way the HTTP API rejects
+// unsigned requests. Nonces are shared with the HTTP API, so a nonce is only ever used once per provider.
+func Signed(secrets SecretStore, nonces repository.NonceStore, window time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !signedMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		if err := checkSignature(ctx, secrets, nonces, window, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func checkSignature(ctx context.Context, secrets SecretStore, nonces repository.NonceStore, window time.Duration, method string, req interface{}) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	timestamp := first(md, TimestampKey)
+	nonce := first(md, NonceKey)
+	signature := first(md, SignatureKey)
+	message, isMessage := req.(proto.Message)
+	from, isSourced := req.(sourced)
+	if !isMessage || !isSourced || from.GetSourceType() == "" ||
+		timestamp == "" || nonce == "" || len(nonce) > maxNonceLength || signature == "" {
+		return withReason(codes.Unauthenticated, codeInvalidSignature, "missing or malformed signature metadata")
+	}
+	provider := from.GetSourceType()
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return withReason(codes.Unauthenticated, codeInvalidSignature, "invalid timestamp")
+	}
+	if math.Abs(float64(time.Now().Unix()-signedAt)) > window.Seconds() {
+		return withReason(codes.Unauthenticated, codeStaleRequest, "call timestamp is outside the replay window")
+	}
+
+	active, err := secrets.Secrets(provider)
+	if err != nil {
+		return unavailable(err)
+	}
+	valid, err := validSignature(active, method, timestamp, nonce, message, signature)
+	if err != nil {
+		return unavailable(err)
+	}
+	if !valid {
+		return withReason(codes.Unauthenticated, codeInvalidSignature, "invalid signature")
+	}
+
+	// nonces are only recorded for valid signatures, so forged calls can't use them up
+	fresh, err := nonces.Remember(ctx, provider, nonce, 2*window)
+	if err != nil {
+		return unavailable(err)
+	}
+	if !fresh {
+		return withReason(codes.Unauthenticated, codeReplayedRequest, "nonce already used")
+	}
+	return nil
+}
+
+// validSignature reports whether signature matches the call signed with any of the active secrets
+func validSignature(secrets []string, method, timestamp, nonce string, req proto.Message, signature string) (bool, error) {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false, nil
+	}
+	valid := false
+	for _, secret := range secrets {
+		expected, err := Sign(secret, method, timestamp, nonce, req)
+		if err != nil {
+			return false, err
+		}
+		want, _ := hex.DecodeString(expected)
+		// every secret is compared, so timing doesn't reveal which one matched
+		if hmac.Equal(got, want) {
+			valid = true
+		}
+	}
+	return valid, nil
+}
+
+// unavailable rejects a call whose signature couldn't be checked
+func unavailable(err error) error {
+	log.Println("signature check failed: ", err)
+	return statusError(err)
+}
+
+// first is the first value of key in md, empty when it isn't set
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,228 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/rpc/walletpb"
+	"github.com/myrachanto/entaingo/src/api/service"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// page sizes for transaction listings, as in the HTTP API
+const (
+	defaultTransactionsLimit = 50
+	maxTransactionsLimit     = 200
+)
+
+// walletServer serves WalletService from the same service as the HTTP API
+type walletServer struct {
+	walletpb.UnimplementedWalletServiceServer
+	service   service.UserServiceInterface
+	providers service.ProviderLookup
+}
+
+// NewServer returns a gRPC server with WalletService registered on it, checking source_type against providers
+func NewServer(ser service.UserServiceInterface, providers service.ProviderLookup, opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	walletpb.RegisterWalletServiceServer(srv, &walletServer{service: ser, providers: providers})
+	return srv
+}
+
+func (server *walletServer) CreateTransaction(ctx context.Context, req *walletpb.CreateTransactionRequest) (*walletpb.CreateTransactionResponse, error) {
+	transaction := &models.TransactionRequest{
+		State:         req.State,
+		Currency:      req.Currency,
+		TransactionID: req.TransactionId,
+		SourceType:    req.SourceType,
+	}
+	amount, err := models.ParseMoney(req.Amount)
+	if err != nil {
+		return nil, invalidFields(models.FieldError{Field: "amount", Message: "must be a decimal number"})
+	}
+	transaction.Amount = amount
+	if req.Currency == "" {
+		return nil, invalidFields(models.FieldError{Field: "currency", Message: "is required"})
+	}
+	if err := transaction.Validate(); err != nil {
+		return nil, invalidFields(err.(*models.ValidationError).Fields...)
+	}
+	provider, err := server.providers.Lookup(req.SourceType)
+	if errors.Is(err, repository.ErrProviderNotFound) {
+		return nil, invalidArgument("invalid source_type")
+	}
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if !provider.Enabled {
+		return nil, statusError(repository.ErrProviderDisabled)
+	}
+	if err := provider.Admits(transaction); err != nil {
+		return nil, invalidFields(err.(*models.ValidationError).Fields...)
+	}
+	if transaction.UserID, err = userID(req.UserId); err != nil {
+		return nil, err
+	}
+	res, err := server.service.Create(transaction)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &walletpb.CreateTransactionResponse{
+		User:        user(res.User),
+		Transaction: firstTransaction(res.Transaction),
+		Replayed:    res.Replayed,
+	}, nil
+}
+
+func (server *walletServer) GetTransactions(ctx context.Context, req *walletpb.GetTransactionsRequest) (*walletpb.GetTransactionsResponse, error) {
+	userId, err := userID(req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	filter := &models.TransactionFilter{
+		UserID:     userId,
+		State:      req.State,
+		SourceType: req.SourceType,
+		Canceled:   req.Canceled,
+		Limit:      defaultTransactionsLimit,
+	}
+	if filter.State != "" && !models.ValidState(filter.State) {
+		return nil, invalidArgument("invalid state")
+	}
+	if filter.SourceType != "" && !server.validSource(filter.SourceType) {
+		return nil, invalidArgument("invalid source_type")
+	}
+	if req.From != nil {
+		from := req.From.AsTime()
+		filter.From = &from
+	}
+	if req.To != nil {
+		to := req.To.AsTime()
+		filter.To = &to
+	}
+	if req.Limit < 0 {
+		return nil, invalidArgument("invalid limit")
+	}
+	if req.Limit > 0 {
+		filter.Limit = int(req.Limit)
+		if filter.Limit > maxTransactionsLimit {
+			filter.Limit = maxTransactionsLimit
+		}
+	}
+	if req.Cursor != "" {
+		cursor, err := models.DecodeCursor(req.Cursor)
+		if err != nil {
+			return nil, invalidArgument(err.Error())
+		}
+		filter.After = cursor
+	}
+
+	userInfo, err := server.service.GetTransactions(filter)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	res := &walletpb.GetTransactionsResponse{
+		User:         user(userInfo.User),
+		Transactions: make([]*walletpb.Transaction, len(userInfo.Transaction)),
+		NextCursor:   userInfo.NextCursor,
+	}
+	for i, t := range userInfo.Transaction {
+		res.Transactions[i] = transaction(t)
+	}
+	return res, nil
+}
+
+func (server *walletServer) GetBalance(ctx context.Context, req *walletpb.GetBalanceRequest) (*walletpb.GetBalanceResponse, error) {
+	userId, err := userID(req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	at := time.Now()
+	if req.At != nil {
+		at = req.At.AsTime()
+	}
+	balance, err := server.service.BalanceAt(userId, at)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	res := &walletpb.GetBalanceResponse{
+		UserId:  uint64(balance.UserID),
+		At:      timestamppb.New(balance.At),
+		Wallets: make([]*walletpb.WalletBalance, len(balance.Wallets)),
+	}
+	for i, wallet := range balance.Wallets {
+		res.Wallets[i] = &walletpb.WalletBalance{Currency: wallet.Currency, Balance: wallet.Balance.String()}
+	}
+	return res, nil
+}
+
+func (server *walletServer) CancelTransaction(ctx context.Context, req *walletpb.CancelTransactionRequest) (*walletpb.CancelTransactionResponse, error) {
+	if req.TransactionId == "" || req.Reason == "" {
+		return nil, invalidArgument("invalid request")
+	}
+	res, err := server.service.CancelTransaction(req.TransactionId, req.Reason)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &walletpb.CancelTransactionResponse{
+		User:        user(res.User),
+		Transaction: firstTransaction(res.Transaction),
+	}, nil
+}
+
+// userID checks a user id fits the uint32 ids of the HTTP API
+func userID(id uint64) (uint, error) {
+	if id == 0 || id > math.MaxUint32 {
+		return 0, invalidArgument("missing or invalid user id")
+	}
+	return uint(id), nil
+}
+
+// validSource accepts the providers of the registry
+func (server *walletServer) validSource(sourceType string) bool {
+	_, err := server.providers.Lookup(sourceType)
+	return err == nil
+}
+
+func user(u models.User) *walletpb.User {
+	res := &walletpb.User{
+		Id:      uint64(u.ID),
+		Status:  u.Status,
+		Wallets: make([]*walletpb.Wallet, len(u.Wallets)),
+	}
+	for i, wallet := range u.Wallets {
+		res.Wallets[i] = &walletpb.Wallet{Id: uint64(wallet.ID), Currency: wallet.Currency, Balance: wallet.Balance.String()}
+	}
+	return res
+}
+
+func firstTransaction(transactions []models.Transaction) *walletpb.Transaction {
+	if len(transactions) == 0 {
+		return nil
+	}
+	return transaction(transactions[0])
+}
+
+func transaction(t models.Transaction) *walletpb.Transaction {
+	res := &walletpb.Transaction{
+		Id:            uint64(t.ID),
+		TransactionId: t.TransactionID,
+		Amount:        t.Amount.String(),
+		Currency:      t.Currency,
+		State:         t.State,
+		SourceType:    t.SourceType,
+		UserId:        uint64(t.UserID),
+		ProcessedAt:   timestamppb.New(t.ProcessedAt),
+		Canceled:      t.Canceled,
+		CancelReason:  t.CancelReason,
+	}
+	if t.CanceledAt != nil {
+		res.CanceledAt = timestamppb.New(*t.CanceledAt)
+	}
+	return res
+}
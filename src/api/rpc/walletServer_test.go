@@ -0,0 +1,478 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/rpc/walletpb"
+	"github.com/myrachanto/entaingo/src/api/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// mockService stubs the calls WalletService makes, the rest of the interface is left unimplemented
+type mockService struct {
+	service.UserServiceInterface
+	mock.Mock
+}
+
+func (m *mockService) Create(transaction *models.TransactionRequest) (*models.UserInfo, error) {
+	args := m.Called(transaction)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.UserInfo), args.Error(1)
+}
+
+func (m *mockService) GetTransactions(filter *models.TransactionFilter) (*models.UserInfo, error) {
+	args := m.Called(filter)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.UserInfo), args.Error(1)
+}
+
+func (m *mockService) BalanceAt(userId uint, at time.Time) (*models.BalanceAsOf, error) {
+	args := m.Called(userId, at)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.BalanceAsOf), args.Error(1)
+}
+
+func (m *mockService) CancelTransaction(transactionId string, reason string) (*models.UserInfo, error) {
+	args := m.Called(transactionId, reason)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.UserInfo), args.Error(1)
+}
+
+// providers is the registry of the test server, retired is disabled
+var providers = service.NewStaticProviders([]models.Provider{
+	models.DefaultProvider("game"),
+	models.DefaultProvider("server"),
+	{Name: "retired", AllowedStates: []string{"win", "lost"}},
+})
+
+// dial serves WalletService over an in-memory listener and returns a client for it
+func dial(t *testing.T, ser service.UserServiceInterface, opts ...grpc.ServerOption) walletpb.WalletServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := NewServer(ser, providers, opts...)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return walletpb.NewWalletServiceClient(conn)
+}
+
+// reason reads the error code a status carries
+func reason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+// violations lists the fields of a status' BadRequest detail
+func violations(err error) []string {
+	var fields []string
+	for _, detail := range status.Convert(err).Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.FieldViolations {
+				fields = append(fields, violation.Field)
+			}
+		}
+	}
+	return fields
+}
+
+func TestWalletServer_CreateTransaction(t *testing.T) {
+	user := models.User{ID: 1, Status: models.UserStatusActive, Wallets: []models.Wallet{{ID: 1, UserID: 1, Currency: "USD", Balance: 11015}}}
+	stored := models.Transaction{ID: 7, TransactionID: "tx1", Amount: 10150, Currency: "USD", State: "win", SourceType: "game", UserID: 1}
+
+	tests := []struct {
+		name           string
+		req            *walletpb.CreateTransactionRequest
+		mockReturn     *models.UserInfo
+		mockError      error
+		expectedCode   codes.Code
+		expectedReason string
+		expectedFields []string
+	}{
+		{
+			name:         "Created",
+			req:          &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "10.15", Currency: "USD", TransactionId: "tx1", SourceType: "game"},
+			mockReturn:   &models.UserInfo{User: user, Transaction: []models.Transaction{stored}},
+			expectedCode: codes.OK,
+		},
+		{
+			name:           "Invalid amount",
+			req:            &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "ten", Currency: "USD", TransactionId: "tx1", SourceType: "game"},
+			expectedCode:   codes.InvalidArgument,
+			expectedReason: codeInvalidRequest,
+		},
+		{
+			name:           "Unknown state and malformed transactionId",
+			req:            &walletpb.CreateTransactionRequest{UserId: 1, State: "completed", Amount: "10.15", Currency: "USD", TransactionId: "tx 1", SourceType: "game"},
+			expectedCode:   codes.InvalidArgument,
+			expectedReason: codeInvalidRequest,
+			expectedFields: []string{"state", "transaction_id"},
+		},
+		{
+			name:           "Non-positive amount",
+			req:            &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "0", Currency: "USD", TransactionId: "tx1", SourceType: "game"},
+			expectedCode:   codes.InvalidArgument,
+			expectedReason: codeInvalidRequest,
+			expectedFields: []string{"amount"},
+		},
+		{
+			name:           "Invalid source type",
+			req:            &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "10.15", Currency: "USD", TransactionId: "tx1", SourceType: "casino"},
+			expectedCode:   codes.InvalidArgument,
+			expectedReason: codeInvalidRequest,
+		},
+		{
+			name:           "Disabled provider",
+			req:            &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "10.15", Currency: "USD", TransactionId: "tx1", SourceType: "retired"},
+			expectedCode:   codes.Aborted,
+			expectedReason: "provider_disabled",
+		},
+		{
+			name:           "Missing user",
+			req:            &walletpb.CreateTransactionRequest{State: "win", Amount: "10.15", Currency: "USD", TransactionId: "tx1", SourceType: "game"},
+			expectedCode:   codes.InvalidArgument,
+			expectedReason: codeInvalidRequest,
+		},
+		{
+			name:           "Unknown account",
+			req:            &walletpb.CreateTransactionRequest{UserId: 2, State: "win", Amount: "10.15", Currency: "USD", TransactionId: "tx1", SourceType: "game"},
+			mockError:      repository.ErrUnknownAccount,
+			expectedCode:   codes.NotFound,
+			expectedReason: "unknown_account",
+		},
+		{
+			name:           "Insufficient funds",
+			req:            &walletpb.CreateTransactionRequest{UserId: 1, State: "lost", Amount: "500", Currency: "USD", TransactionId: "tx1", SourceType: "game"},
+			mockError:      repository.ErrInsufficientFunds,
+			expectedCode:   codes.FailedPrecondition,
+			expectedReason: "insufficient_funds",
+		},
+		{
+			name:           "Reused transactionId",
+			req:            &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "1", Currency: "USD", TransactionId: "tx1", SourceType: "game"},
+			mockError:      repository.ErrTransactionConflict,
+			expectedCode:   codes.AlreadyExists,
+			expectedReason: "duplicate_transaction",
+		},
+		{
+			name:           "Version conflict",
+			req:            &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "1", Currency: "USD", TransactionId: "tx1", SourceType: "game"},
+			mockError:      repository.ErrVersionConflict,
+			expectedCode:   codes.Aborted,
+			expectedReason: "version_conflict",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ser := &mockService{}
+			if tt.mockReturn != nil || tt.mockError != nil {
+				ser.On("Create", mock.AnythingOfType("*models.TransactionRequest")).Return(tt.mockReturn, tt.mockError)
+			}
+			client := dial(t, ser)
+
+			res, err := client.CreateTransaction(context.Background(), tt.req)
+
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			assert.Equal(t, tt.expectedReason, reason(err))
+			if tt.expectedFields != nil {
+				assert.Equal(t, tt.expectedFields, violations(err))
+			}
+			if tt.expectedCode == codes.OK {
+				assert.Equal(t, "11.015", res.User.Wallets[0].Balance)
+				assert.Equal(t, "tx1", res.Transaction.TransactionId)
+				assert.Equal(t, "10.150", res.Transaction.Amount)
+				req := ser.Calls[0].Arguments.Get(0).(*models.TransactionRequest)
+				assert.Equal(t, models.Money(10150), req.Amount)
+				assert.Equal(t, uint(1), req.UserID)
+				assert.Equal(t, "game", req.SourceType)
+			}
+			ser.AssertExpectations(t)
+		})
+	}
+}
+
+// staticSecrets serves fixed secrets per provider
+type staticSecrets map[string][]string
+
+func (s staticSecrets) Secrets(provider string) ([]string, error) {
+	return s[provider], nil
+}
+
+// signed attaches the signature of a call of method with req to ctx
+func signed(t *testing.T, secret, method, nonce string, req proto.Message) context.Context {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := Sign(secret, method, timestamp, nonce, req)
+	assert.NoError(t, err)
+	return metadata.AppendToOutgoingContext(context.Background(), TimestampKey, timestamp, NonceKey, nonce, SignatureKey, signature)
+}
+
+func TestWalletServer_SignedCreateTransaction(t *testing.T) {
+	method := walletpb.WalletService_CreateTransaction_FullMethodName
+	req := &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "10.15", Currency: "USD", TransactionId: "tx1", SourceType: "game"}
+	ser := &mockService{}
+	ser.On("Create", mock.AnythingOfType("*models.TransactionRequest")).
+		Return(&models.UserInfo{User: models.User{ID: 1}, Transaction: []models.Transaction{{ID: 7, TransactionID: "tx1"}}}, nil).Once()
+	secrets := staticSecrets{"game": {"game-secret"}, "server": {"server-secret"}}
+	client := dial(t, ser, grpc.UnaryInterceptor(Signed(secrets, repository.NewMemoryNonces(), time.Minute)))
+
+	_, err := client.CreateTransaction(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "an unsigned call moves no money")
+	assert.Equal(t, codeInvalidSignature, reason(err))
+
+	_, err = client.CreateTransaction(signed(t, "server-secret", method, "n-1", req), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "signed by a provider other than its source_type")
+
+	tampered := proto.Clone(req).(*walletpb.CreateTransactionRequest)
+	tampered.Amount = "1000"
+	_, err = client.CreateTransaction(signed(t, "game-secret", method, "n-2", req), tampered)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "the signature covers the message")
+
+	ctx := signed(t, "game-secret", method, "n-3", req)
+	res, err := client.CreateTransaction(ctx, req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tx1", res.Transaction.TransactionId)
+	}
+	_, err = client.CreateTransaction(ctx, req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, codeReplayedRequest, reason(err))
+	ser.AssertExpectations(t)
+}
+
+// staticTokens maps bearer tokens to their callers
+type staticTokens map[string]Caller
+
+func (s staticTokens) VerifyCaller(token string) (Caller, error) {
+	caller, ok := s[token]
+	if !ok {
+		return Caller{}, assert.AnError
+	}
+	return caller, nil
+}
+
+// bearer attaches token to the context of a call
+func bearer(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestWalletServer_Authenticated(t *testing.T) {
+	tokens := staticTokens{"player-1": {UserID: 1}, "player-2": {UserID: 2}, "staff": {Staff: true}}
+	ser := &mockService{}
+	ser.On("BalanceAt", uint(1), mock.AnythingOfType("time.Time")).Return(&models.BalanceAsOf{UserID: 1}, nil)
+	ser.On("GetTransactions", mock.AnythingOfType("*models.TransactionFilter")).Return(&models.UserInfo{User: models.User{ID: 1}}, nil)
+	ser.On("CancelTransaction", "tx1", models.CancelReasonFraud).Return(&models.UserInfo{User: models.User{ID: 1}}, nil)
+	client := dial(t, ser, grpc.UnaryInterceptor(Authenticated(tokens)))
+	balance := func(ctx context.Context) error {
+		_, err := client.GetBalance(ctx, &walletpb.GetBalanceRequest{UserId: 1})
+		return err
+	}
+	transactions := func(ctx context.Context) error {
+		_, err := client.GetTransactions(ctx, &walletpb.GetTransactionsRequest{UserId: 1})
+		return err
+	}
+	cancel := func(ctx context.Context) error {
+		_, err := client.CancelTransaction(ctx, &walletpb.CancelTransactionRequest{TransactionId: "tx1", Reason: models.CancelReasonFraud})
+		return err
+	}
+
+	tests := []struct {
+		name         string
+		call         func(ctx context.Context) error
+		ctx          context.Context
+		expectedCode codes.Code
+	}{
+		{"anonymous balance", balance, context.Background(), codes.Unauthenticated},
+		{"invalid token", balance, bearer("forged"), codes.Unauthenticated},
+		{"own balance", balance, bearer("player-1"), codes.OK},
+		{"another player's balance", balance, bearer("player-2"), codes.PermissionDenied},
+		{"staff balance", balance, bearer("staff"), codes.OK},
+		{"anonymous transactions", transactions, context.Background(), codes.Unauthenticated},
+		{"own transactions", transactions, bearer("player-1"), codes.OK},
+		{"another player's transactions", transactions, bearer("player-2"), codes.PermissionDenied},
+		{"anonymous cancellation", cancel, context.Background(), codes.Unauthenticated},
+		{"player cancellation", cancel, bearer("player-1"), codes.PermissionDenied},
+		{"staff cancellation", cancel, bearer("staff"), codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call(tt.ctx)
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			switch tt.expectedCode {
+			case codes.Unauthenticated:
+				assert.Equal(t, codeUnauthenticated, reason(err))
+			case codes.PermissionDenied:
+				assert.Equal(t, codeForbidden, reason(err))
+			}
+		})
+	}
+}
+
+// exhaustedLimiter holds every provider over its rate
+type exhaustedLimiter struct{}
+
+func (exhaustedLimiter) AllowProvider(provider string) (bool, time.Duration) {
+	return false, 1500 * time.Millisecond
+}
+
+func TestWalletServer_Throttled(t *testing.T) {
+	client := dial(t, &mockService{}, grpc.ChainUnaryInterceptor(Throttled(exhaustedLimiter{}), Authenticated(staticTokens{})))
+
+	_, err := client.CreateTransaction(context.Background(), &walletpb.CreateTransactionRequest{UserId: 1, State: "win", Amount: "1", Currency: "USD", TransactionId: "tx1", SourceType: "game"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, codeRateLimited, reason(err))
+	var retry *errdetails.RetryInfo
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retry = info
+		}
+	}
+	if assert.NotNil(t, retry) {
+		assert.Equal(t, 1500*time.Millisecond, retry.RetryDelay.AsDuration())
+	}
+
+	_, err = client.GetBalance(context.Background(), &walletpb.GetBalanceRequest{UserId: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "reads aren't throttled per provider")
+}
+
+func TestWalletServer_GetTransactions(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	canceled := true
+
+	t.Run("Filters", func(t *testing.T) {
+		ser := &mockService{}
+		ser.On("GetTransactions", &models.TransactionFilter{UserID: 1, State: "win", Canceled: &canceled, From: &from, Limit: maxTransactionsLimit}).
+			Return(&models.UserInfo{User: models.User{ID: 1}, Transaction: []models.Transaction{{ID: 3, TransactionID: "tx3"}}, NextCursor: "abc"}, nil)
+		client := dial(t, ser)
+
+		res, err := client.GetTransactions(context.Background(), &walletpb.GetTransactionsRequest{UserId: 1, State: "win", Canceled: &canceled, From: timestamppb.New(from), Limit: 1000})
+
+		assert.NoError(t, err)
+		assert.Len(t, res.Transactions, 1)
+		assert.Equal(t, "abc", res.NextCursor)
+		ser.AssertExpectations(t)
+	})
+
+	t.Run("Invalid state", func(t *testing.T) {
+		client := dial(t, &mockService{})
+		_, err := client.GetTransactions(context.Background(), &walletpb.GetTransactionsRequest{UserId: 1, State: "draw"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("Invalid cursor", func(t *testing.T) {
+		client := dial(t, &mockService{})
+		_, err := client.GetTransactions(context.Background(), &walletpb.GetTransactionsRequest{UserId: 1, Cursor: "!"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("Unknown account", func(t *testing.T) {
+		ser := &mockService{}
+		ser.On("GetTransactions", mock.Anything).Return(nil, repository.ErrUnknownAccount)
+		client := dial(t, ser)
+		_, err := client.GetTransactions(context.Background(), &walletpb.GetTransactionsRequest{UserId: 9})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+func TestWalletServer_GetBalance(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("As of an instant", func(t *testing.T) {
+		ser := &mockService{}
+		ser.On("BalanceAt", uint(1), at).Return(&models.BalanceAsOf{UserID: 1, At: at, Wallets: []models.WalletBalance{{Currency: "USD", Balance: 2500}}}, nil)
+		client := dial(t, ser)
+
+		res, err := client.GetBalance(context.Background(), &walletpb.GetBalanceRequest{UserId: 1, At: timestamppb.New(at)})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "2.500", res.Wallets[0].Balance)
+		assert.True(t, at.Equal(res.At.AsTime()))
+		ser.AssertExpectations(t)
+	})
+
+	t.Run("Database unavailable", func(t *testing.T) {
+		ser := &mockService{}
+		ser.On("BalanceAt", uint(1), mock.AnythingOfType("time.Time")).Return(nil, repository.ErrUnavailable)
+		client := dial(t, ser)
+
+		_, err := client.GetBalance(context.Background(), &walletpb.GetBalanceRequest{UserId: 1})
+
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Equal(t, "unavailable", reason(err))
+	})
+}
+
+func TestWalletServer_CancelTransaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		req          *walletpb.CancelTransactionRequest
+		mockError    error
+		expectedCode codes.Code
+	}{
+		{"Canceled", &walletpb.CancelTransactionRequest{TransactionId: "tx1", Reason: models.CancelReasonFraud}, nil, codes.OK},
+		{"Missing reason", &walletpb.CancelTransactionRequest{TransactionId: "tx1"}, nil, codes.InvalidArgument},
+		{"Invalid reason", &walletpb.CancelTransactionRequest{TransactionId: "tx1", Reason: "boredom"}, repository.ErrInvalidCancelReason, codes.InvalidArgument},
+		{"Already canceled", &walletpb.CancelTransactionRequest{TransactionId: "tx1", Reason: models.CancelReasonFraud}, repository.ErrAlreadyCanceled, codes.Aborted},
+		{"Unknown transaction", &walletpb.CancelTransactionRequest{TransactionId: "tx9", Reason: models.CancelReasonFraud}, repository.ErrTransactionNotFound, codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ser := &mockService{}
+			if tt.req.Reason != "" {
+				var res *models.UserInfo
+				if tt.mockError == nil {
+					res = &models.UserInfo{User: models.User{ID: 1}, Transaction: []models.Transaction{{ID: 1, TransactionID: "tx1", Canceled: true, CancelReason: tt.req.Reason}}}
+				}
+				ser.On("CancelTransaction", tt.req.TransactionId, tt.req.Reason).Return(res, tt.mockError)
+			}
+			client := dial(t, ser)
+
+			res, err := client.CancelTransaction(context.Background(), tt.req)
+
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if tt.expectedCode == codes.OK {
+				assert.True(t, res.Transaction.Canceled)
+			}
+			ser.AssertExpectations(t)
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	err := statusError(assert.AnError)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, codeInternal, reason(err))
+}
@@ -0,0 +1,333 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/myrachanto/entaingo/src/api/models"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 64
+
+// balancePollInterval is how often the journal is read for new balance events when no local write wakes the broker
+const balancePollInterval = time.Second
+
+// balancePollBatch caps the events read from the journal at once
+const balancePollBatch = 500
+
+// gapTimeout is how long a missing journal entry holds back the events after it. Entry ids are taken
+// before commit, so a lower id may still be committing; past the timeout it is taken as rolled back.
+const gapTimeout = 2 * time.Second
+
+// EventSource reads balance events back from the journal, numbered by journal entry id
+type EventSource interface {
+	BalanceEvents(afterSeq uint64, userId uint, limit int) ([]models.BalanceEvent, error)
+	LastEventSeq() (uint64, error)
+}
+
+// BalanceBroker fans the balance events of the journal out to the subscribers of each user.
+// Every replica polls the shared journal, so subscribers see the changes made through any replica,
+// and resuming clients are replayed their missed events from the journal, whichever replica they reconnect to.
+// Only users with a subscriber are tracked.
+type BalanceBroker struct {
+	source  EventSource
+	history int
+	now     func() time.Time
+	wake    chan struct{}
+
+	mu       sync.Mutex
+	users    map[uint]map[chan models.BalanceEvent]uint64 // each subscriber and the last event it has
+	started  bool
+	cursor   uint64    // every event up to it has been delivered or given up on
+	gapSince time.Time // when the event after cursor was first found missing
+}
+
+// Subscription is a live feed of one user's balance events
+type Subscription struct {
+	// Replay holds the events missed since the resumed sequence number
+	Replay []models.BalanceEvent
+	// Reset is set when the missed events are too many to replay or the sequence number is unknown,
+	// the client should reload the balance
+	Reset bool
+	// Events delivers new events; it is closed when the subscriber falls too far behind or the broker stops
+	Events <-chan models.BalanceEvent
+
+	close func()
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.close()
+}
+
+// NewBalanceBroker reads balance events from source and replays at most history of them to a resuming client
+func NewBalanceBroker(source EventSource, history int) *BalanceBroker {
+	return &BalanceBroker{
+		source:  source,
+		history: history,
+		now:     time.Now,
+		wake:    make(chan struct{}, 1),
+		users:   map[uint]map[chan models.BalanceEvent]uint64{},
+	}
+}
+
+// Run polls the journal every balancePollInterval, or as soon as Wake is called, until ctx is done.
+// The subscriptions left are then closed so their streams end.
+func (b *BalanceBroker) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(balancePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.wake:
+		case <-ctx.Done():
+			b.closeAll()
+			return
+		}
+		if err := b.Poll(); err != nil {
+			log.Println("failed to poll balance events: ", err)
+		}
+	}
+}
+
+// Wake polls the journal without waiting for the next tick, after a write through this replica
+func (b *BalanceBroker) Wake() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Poll delivers the events journaled since the last poll, in sequence order. Events after a missing
+// entry are held back until it shows up or gapTimeout passes.
+func (b *BalanceBroker) Poll() error {
+	if err := b.start(); err != nil {
+		return err
+	}
+	if idle, err := b.skipIdle(); idle || err != nil {
+		return err
+	}
+	for {
+		b.mu.Lock()
+		cursor := b.cursor
+		b.mu.Unlock()
+		events, err := b.source.BalanceEvents(cursor, 0, balancePollBatch)
+		if err != nil {
+			return err
+		}
+		b.mu.Lock()
+		held := b.deliver(events)
+		b.mu.Unlock()
+		if held || len(events) < balancePollBatch {
+			return nil
+		}
+	}
+}
+
+// skipIdle moves the cursor to the end of the journal while no one is subscribed, instead of reading
+// events no one would get. Subscribers joining later are replayed what they missed from the journal.
+func (b *BalanceBroker) skipIdle() (bool, error) {
+	b.mu.Lock()
+	idle := len(b.users) == 0
+	b.mu.Unlock()
+	if !idle {
+		return false, nil
+	}
+	seq, err := b.source.LastEventSeq()
+	if err != nil {
+		return true, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.users) > 0 {
+		// a subscriber joined meanwhile and expects the events after the cursor
+		return false, nil
+	}
+	if seq > b.cursor {
+		b.cursor, b.gapSince = seq, time.Time{}
+	}
+	return true, nil
+}
+
+// start begins from the end of the journal, the events before it are only replayed on request
+func (b *BalanceBroker) start() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.started {
+		return nil
+	}
+	seq, err := b.source.LastEventSeq()
+	if err != nil {
+		return err
+	}
+	b.cursor, b.started = seq, true
+	return nil
+}
+
+// deliver publishes events past the cursor in order, reporting whether it stopped at a missing entry
+func (b *BalanceBroker) deliver(events []models.BalanceEvent) bool {
+	for _, event := range events {
+		if event.Seq <= b.cursor {
+			continue
+		}
+		if event.Seq > b.cursor+1 {
+			now := b.now()
+			if b.gapSince.IsZero() {
+				b.gapSince = now
+			}
+			if now.Sub(b.gapSince) < gapTimeout {
+				return true
+			}
+		}
+		b.gapSince = time.Time{}
+		b.cursor = event.Seq
+		b.publish(event)
+	}
+	return false
+}
+
+// publish delivers the event to the user's subscribers that don't have it yet.
+// A subscriber whose buffer is full is dropped rather than holding the others up; it can resume.
+func (b *BalanceBroker) publish(event models.BalanceEvent) {
+	subs := b.users[event.UserID]
+	for ch, last := range subs {
+		if event.Seq <= last {
+			continue
+		}
+		select {
+		case ch <- event:
+			subs[ch] = event.Seq
+		default:
+			b.unsubscribe(event.UserID, ch)
+		}
+	}
+}
+
+// Subscribe starts a feed of the user's events. With resume set, the events after lastSeq are replayed
+// first, or Reset is set when there are more than the broker replays.
+func (b *BalanceBroker) Subscribe(userId uint, lastSeq uint64, resume bool) (*Subscription, error) {
+	if err := b.start(); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	ch := make(chan models.BalanceEvent, subscriberBuffer)
+	subs, ok := b.users[userId]
+	if !ok {
+		subs = map[chan models.BalanceEvent]uint64{}
+		b.users[userId] = subs
+	}
+	// events up to the cursor are replayed, later ones are delivered live
+	upTo := b.cursor
+	subs[ch] = upTo
+	b.mu.Unlock()
+
+	sub := &Subscription{
+		Events: ch,
+		close: func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.unsubscribe(userId, ch)
+		},
+	}
+	if !resume || lastSeq == upTo {
+		return sub, nil
+	}
+	if lastSeq > upTo {
+		// another replica may have delivered it already, but not a journal that has never reached it
+		last, err := b.source.LastEventSeq()
+		if err != nil {
+			sub.Close()
+			return nil, err
+		}
+		if lastSeq > last {
+			sub.Reset = true
+			return sub, nil
+		}
+		b.mu.Lock()
+		if last, ok := subs[ch]; ok && last < lastSeq {
+			subs[ch] = lastSeq
+		}
+		b.mu.Unlock()
+		return sub, nil
+	}
+
+	missed, err := b.source.BalanceEvents(lastSeq, userId, b.history+1)
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+	for _, event := range missed {
+		if event.Seq <= upTo {
+			sub.Replay = append(sub.Replay, event)
+		}
+	}
+	if len(sub.Replay) > b.history {
+		sub.Replay, sub.Reset = nil, true
+	}
+	return sub, nil
+}
+
+// unsubscribe closes the subscriber's feed, and forgets the user with their last subscriber
+func (b *BalanceBroker) unsubscribe(userId uint, ch chan models.BalanceEvent) {
+	subs := b.users[userId]
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(b.users, userId)
+	}
+}
+
+func (b *BalanceBroker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for userId, subs := range b.users {
+		for ch := range subs {
+			b.unsubscribe(userId, ch)
+		}
+	}
+}
+
+// MemoryEvents is an EventSource held in memory, for tests and runs without a database
+type MemoryEvents struct {
+	mu     sync.Mutex
+	events []models.BalanceEvent
+}
+
+// NewMemoryEvents starts an empty journal
+func NewMemoryEvents() *MemoryEvents {
+	return &MemoryEvents{}
+}
+
+// Append journals the event under the next sequence number
+func (m *MemoryEvents) Append(event models.BalanceEvent) models.BalanceEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event.Seq = uint64(len(m.events) + 1)
+	m.events = append(m.events, event)
+	return event
+}
+
+func (m *MemoryEvents) BalanceEvents(afterSeq uint64, userId uint, limit int) ([]models.BalanceEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []models.BalanceEvent{}
+	for _, event := range m.events {
+		if event.Seq > afterSeq && (userId == 0 || event.UserID == userId) && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *MemoryEvents) LastEventSeq() (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint64(len(m.events)), nil
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBalanceBroker(t *testing.T) {
+	journal := NewMemoryEvents()
+	journal.Append(models.BalanceEvent{UserID: 1})
+	broker := NewBalanceBroker(journal, 3)
+	live, err := broker.Subscribe(1, 0, false)
+	assert.NoError(t, err)
+	other, err := broker.Subscribe(2, 0, false)
+	assert.NoError(t, err)
+
+	for i := 2; i <= 6; i++ {
+		journal.Append(models.BalanceEvent{UserID: 1, Balance: models.Money(i)})
+	}
+	journal.Append(models.BalanceEvent{UserID: 2})
+	assert.NoError(t, broker.Poll())
+
+	for i := 2; i <= 6; i++ {
+		event := <-live.Events
+		assert.Equal(t, uint64(i), event.Seq, "events are numbered by the journal, from where it was at the start")
+	}
+	assert.Equal(t, uint64(7), (<-other.Events).Seq, "subscribers only see their user's events")
+
+	// a replica started after the events replays them from the journal
+	restarted := NewBalanceBroker(journal, 3)
+	resumed, err := restarted.Subscribe(1, 3, true)
+	assert.NoError(t, err)
+	assert.False(t, resumed.Reset)
+	assert.Equal(t, []uint64{4, 5, 6}, seqs(resumed.Replay))
+
+	upToDate, _ := restarted.Subscribe(1, 7, true)
+	assert.False(t, upToDate.Reset)
+	assert.Empty(t, upToDate.Replay)
+
+	tooOld, _ := restarted.Subscribe(1, 1, true)
+	assert.True(t, tooOld.Reset, "5 missed events are more than the 3 replayed")
+	assert.Empty(t, tooOld.Replay)
+
+	unknown, _ := restarted.Subscribe(1, 42, true)
+	assert.True(t, unknown.Reset, "a sequence number the journal never reached")
+
+	live.Close()
+	live.Close()
+	_, open := <-live.Events
+	assert.False(t, open)
+}
+
+func TestBalanceBrokerResumesAheadOfItsPoll(t *testing.T) {
+	journal := NewMemoryEvents()
+	broker := NewBalanceBroker(journal, 10)
+	assert.NoError(t, broker.Poll())
+	journal.Append(models.BalanceEvent{UserID: 1})
+	journal.Append(models.BalanceEvent{UserID: 1})
+
+	// the client saw event 1 through a replica that polled first
+	sub, err := broker.Subscribe(1, 1, true)
+	assert.NoError(t, err)
+	assert.False(t, sub.Reset)
+	assert.NoError(t, broker.Poll())
+	sub.Close()
+	assert.Equal(t, []uint64{2}, seqs(collect(sub.Events)), "events it already has aren't sent again")
+}
+
+func TestBalanceBrokerHoldsEventsBehindAGap(t *testing.T) {
+	now := time.Date(2024, 10, 22, 12, 0, 0, 0, time.UTC)
+	journal := &gappedEvents{MemoryEvents: NewMemoryEvents(), missing: map[uint64]bool{}}
+	broker := NewBalanceBroker(journal, 10)
+	broker.now = func() time.Time { return now }
+	sub, _ := broker.Subscribe(1, 0, false)
+
+	journal.Append(models.BalanceEvent{UserID: 1})
+	journal.missing[2] = true // still committing
+	journal.Append(models.BalanceEvent{UserID: 1})
+	journal.Append(models.BalanceEvent{UserID: 1})
+	assert.NoError(t, broker.Poll())
+	assert.Equal(t, uint64(1), (<-sub.Events).Seq)
+	assert.Empty(t, sub.Events, "events after the missing entry wait for it")
+
+	delete(journal.missing, 2)
+	assert.NoError(t, broker.Poll())
+	assert.Equal(t, []uint64{2, 3}, []uint64{(<-sub.Events).Seq, (<-sub.Events).Seq}, "and follow it in order")
+
+	journal.missing[4] = true // rolled back
+	journal.Append(models.BalanceEvent{UserID: 1})
+	journal.Append(models.BalanceEvent{UserID: 1})
+	assert.NoError(t, broker.Poll())
+	assert.Empty(t, sub.Events)
+	now = now.Add(gapTimeout)
+	assert.NoError(t, broker.Poll())
+	assert.Equal(t, uint64(5), (<-sub.Events).Seq, "an entry missing past the timeout is skipped")
+	sub.Close()
+}
+
+func TestBalanceBrokerForgetsIdleUsers(t *testing.T) {
+	journal := NewMemoryEvents()
+	broker := NewBalanceBroker(journal, 10)
+	first, _ := broker.Subscribe(1, 0, false)
+	second, _ := broker.Subscribe(1, 0, false)
+	first.Close()
+	assert.Len(t, broker.users, 1)
+	second.Close()
+	assert.Empty(t, broker.users, "nothing is kept for a user without subscribers")
+}
+
+func TestBalanceBrokerSkipsTheJournalWhileIdle(t *testing.T) {
+	journal := &countingEvents{MemoryEvents: NewMemoryEvents()}
+	broker := NewBalanceBroker(journal, 10)
+	assert.NoError(t, broker.Poll())
+	journal.Append(models.BalanceEvent{UserID: 1})
+	journal.Append(models.BalanceEvent{UserID: 2})
+	assert.NoError(t, broker.Poll())
+	assert.Zero(t, journal.reads, "no events are read without subscribers")
+	assert.Equal(t, uint64(2), broker.cursor, "the cursor follows the end of the journal")
+
+	sub, _ := broker.Subscribe(1, 0, true)
+	assert.Equal(t, []uint64{1}, seqs(sub.Replay), "events skipped while idle are replayed on request")
+	journal.Append(models.BalanceEvent{UserID: 1})
+	assert.NoError(t, broker.Poll())
+	assert.Equal(t, uint64(3), (<-sub.Events).Seq)
+	sub.Close()
+}
+
+func TestBalanceBrokerDropsSlowSubscribers(t *testing.T) {
+	journal := NewMemoryEvents()
+	broker := NewBalanceBroker(journal, subscriberBuffer*2)
+	slow, _ := broker.Subscribe(1, 0, false)
+	for i := 0; i <= subscriberBuffer; i++ {
+		journal.Append(models.BalanceEvent{UserID: 1})
+	}
+	assert.NoError(t, broker.Poll())
+
+	received := len(collect(slow.Events))
+	assert.Equal(t, subscriberBuffer, received, "the buffered events are delivered, then the feed ends")
+	assert.Empty(t, broker.users, "the dropped subscriber is forgotten")
+
+	resumed, _ := broker.Subscribe(1, uint64(received), true)
+	assert.Equal(t, []uint64{subscriberBuffer + 1}, seqs(resumed.Replay), "the dropped subscriber resumes where it left off")
+	resumed.Close()
+}
+
+// gappedEvents hides the missing entries, as if they weren't committed yet
+type gappedEvents struct {
+	*MemoryEvents
+	missing map[uint64]bool
+}
+
+func (g *gappedEvents) BalanceEvents(afterSeq uint64, userId uint, limit int) ([]models.BalanceEvent, error) {
+	events, err := g.MemoryEvents.BalanceEvents(afterSeq, userId, limit)
+	visible := []models.BalanceEvent{}
+	for _, event := range events {
+		if !g.missing[event.Seq] {
+			visible = append(visible, event)
+		}
+	}
+	return visible, err
+}
+
+// countingEvents counts the reads of the journal's events
+type countingEvents struct {
+	*MemoryEvents
+	reads int
+}
+
+func (c *countingEvents) BalanceEvents(afterSeq uint64, userId uint, limit int) ([]models.BalanceEvent, error) {
+	c.reads++
+	return c.MemoryEvents.BalanceEvents(afterSeq, userId, limit)
+}
+
+func collect(events <-chan models.BalanceEvent) []models.BalanceEvent {
+	result := []models.BalanceEvent{}
+	for event := range events {
+		result = append(result, event)
+	}
+	return result
+}
+
+func seqs(events []models.BalanceEvent) []uint64 {
+	result := []uint64{}
+	for _, event := range events {
+		result = append(result, event.Seq)
+	}
+	return result
+}
@@ -0,0 +1,26 @@
+package service
+
+import (
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+)
+
+type JobServiceInterface interface {
+	GetCancellationRuns(limit int) ([]models.CancellationRun, error)
+	GetCancellationRun(runId uint) (*models.CancellationRun, error)
+}
+type jobService struct {
+	repo repository.JobrepoInterface
+}
+
+func NewJobService(repository repository.JobrepoInterface) JobServiceInterface {
+	return &jobService{
+		repository,
+	}
+}
+func (service *jobService) GetCancellationRuns(limit int) ([]models.CancellationRun, error) {
+	return service.repo.GetCancellationRuns(limit)
+}
+func (service *jobService) GetCancellationRun(runId uint) (*models.CancellationRun, error) {
+	return service.repo.GetCancellationRun(runId)
+}
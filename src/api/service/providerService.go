@@ -0,0 +1,172 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+)
+
+// ProviderLookup finds the provider a request names in Source-Type
+type ProviderLookup interface {
+	// Lookup returns the named provider, or ErrProviderNotFound
+	Lookup(name string) (*models.Provider, error)
+	// Secrets returns the active signing secrets of provider, the current one first
+	Secrets(provider string) ([]string, error)
+}
+
+type ProviderServiceInterface interface {
+	ProviderLookup
+	GetProviders() ([]models.Provider, error)
+	GetProvider(name string) (*models.Provider, error)
+	CreateProvider(req *models.ProviderRequest) (*models.Provider, error)
+	UpdateProvider(name string, req *models.ProviderRequest) (*models.Provider, error)
+	DeleteProvider(name string) error
+	// Invalidate drops the cached registry, the next lookup reloads it
+	Invalidate()
+}
+
+// providerService serves lookups from an in-memory copy of the registry.
+// Its own changes invalidate the copy at once; changes made through another
+// replica are picked up when the copy is older than ttl.
+type providerService struct {
+	repo     repository.ProviderRepoInterface
+	ttl      time.Duration
+	now      func() time.Time
+	mu       sync.RWMutex
+	cache    map[string]models.Provider
+	loadedAt time.Time
+}
+
+// NewProviderService caches the registry for ttl between reloads
+func NewProviderService(repository repository.ProviderRepoInterface, ttl time.Duration) ProviderServiceInterface {
+	return &providerService{
+		repo: repository,
+		ttl:  ttl,
+		now:  time.Now,
+	}
+}
+
+func (service *providerService) Lookup(name string) (*models.Provider, error) {
+	providers, err := service.providers()
+	if err != nil {
+		return nil, err
+	}
+	provider, ok := providers[name]
+	if !ok {
+		return nil, repository.ErrProviderNotFound
+	}
+	return &provider, nil
+}
+
+func (service *providerService) Secrets(name string) ([]string, error) {
+	provider, err := service.Lookup(name)
+	if err == repository.ErrProviderNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return provider.Secrets(), nil
+}
+
+// providers returns the cached registry, reloading it when it is missing or stale.
+// A failed reload keeps serving the stale copy rather than failing every request.
+func (service *providerService) providers() (map[string]models.Provider, error) {
+	service.mu.RLock()
+	cache, loadedAt := service.cache, service.loadedAt
+	service.mu.RUnlock()
+	if cache != nil && service.now().Sub(loadedAt) < service.ttl {
+		return cache, nil
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	// another request may have reloaded it meanwhile
+	if service.cache != nil && service.now().Sub(service.loadedAt) < service.ttl {
+		return service.cache, nil
+	}
+	list, err := service.repo.GetProviders()
+	if err != nil {
+		if service.cache != nil {
+			log.Println("Failed to reload providers, serving the cached ones: ", err)
+			return service.cache, nil
+		}
+		return nil, err
+	}
+	service.cache = make(map[string]models.Provider, len(list))
+	for _, provider := range list {
+		service.cache[provider.Name] = provider
+	}
+	service.loadedAt = service.now()
+	return service.cache, nil
+}
+
+func (service *providerService) Invalidate() {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.cache = nil
+}
+
+func (service *providerService) GetProviders() ([]models.Provider, error) {
+	return service.repo.GetProviders()
+}
+func (service *providerService) GetProvider(name string) (*models.Provider, error) {
+	return service.repo.GetProvider(name)
+}
+func (service *providerService) CreateProvider(req *models.ProviderRequest) (*models.Provider, error) {
+	provider := &models.Provider{}
+	if err := req.Apply(provider, true); err != nil {
+		return nil, err
+	}
+	res, err := service.repo.CreateProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	service.Invalidate()
+	return res, nil
+}
+func (service *providerService) UpdateProvider(name string, req *models.ProviderRequest) (*models.Provider, error) {
+	res, err := service.repo.UpdateProvider(name, func(provider *models.Provider) error {
+		return req.Apply(provider, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	service.Invalidate()
+	return res, nil
+}
+func (service *providerService) DeleteProvider(name string) error {
+	if err := service.repo.DeleteProvider(name); err != nil {
+		return err
+	}
+	service.Invalidate()
+	return nil
+}
+
+// staticProviders is a fixed registry, for running without a database
+type staticProviders map[string]models.Provider
+
+// NewStaticProviders serves lookups from a fixed list of providers
+func NewStaticProviders(providers []models.Provider) ProviderLookup {
+	registry := staticProviders{}
+	for _, provider := range providers {
+		registry[provider.Name] = provider
+	}
+	return registry
+}
+
+func (registry staticProviders) Lookup(name string) (*models.Provider, error) {
+	provider, ok := registry[name]
+	if !ok {
+		return nil, repository.ErrProviderNotFound
+	}
+	return &provider, nil
+}
+
+func (registry staticProviders) Secrets(name string) ([]string, error) {
+	provider := registry[name]
+	return provider.Secrets(), nil
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// providerRepo is an in-memory registry that counts its reads
+type providerRepo struct {
+	repository.ProviderRepoInterface
+	providers map[string]models.Provider
+	reads     int
+	err       error
+}
+
+func (r *providerRepo) GetProviders() ([]models.Provider, error) {
+	r.reads++
+	if r.err != nil {
+		return nil, r.err
+	}
+	list := []models.Provider{}
+	for _, provider := range r.providers {
+		list = append(list, provider)
+	}
+	return list, nil
+}
+
+func (r *providerRepo) UpdateProvider(name string, update func(provider *models.Provider) error) (*models.Provider, error) {
+	provider, ok := r.providers[name]
+	if !ok {
+		return nil, repository.ErrProviderNotFound
+	}
+	if err := update(&provider); err != nil {
+		return nil, err
+	}
+	r.providers[name] = provider
+	return &provider, nil
+}
+
+func TestProviderServiceCache(t *testing.T) {
+	now := time.Date(2024, 10, 22, 12, 0, 0, 0, time.UTC)
+	game := models.DefaultProvider("game")
+	game.Secret = "s1"
+	repo := &providerRepo{providers: map[string]models.Provider{"game": game}}
+	service := NewProviderService(repo, time.Minute).(*providerService)
+	service.now = func() time.Time { return now }
+
+	provider, err := service.Lookup("game")
+	assert.NoError(t, err)
+	assert.True(t, provider.Enabled)
+	_, err = service.Lookup("casino")
+	assert.Equal(t, repository.ErrProviderNotFound, err)
+	assert.Equal(t, 1, repo.reads, "lookups are served from the cache")
+
+	// a change through this replica invalidates the cache at once
+	disabled := false
+	_, err = service.UpdateProvider("game", &models.ProviderRequest{Enabled: &disabled, Secret: "s2"})
+	assert.NoError(t, err)
+	provider, _ = service.Lookup("game")
+	assert.False(t, provider.Enabled)
+	secrets, _ := service.Secrets("game")
+	assert.Equal(t, []string{"s2", "s1"}, secrets)
+	assert.Equal(t, 2, repo.reads)
+
+	// a change through another replica shows once the cache is stale
+	repo.providers["casino"] = models.DefaultProvider("casino")
+	_, err = service.Lookup("casino")
+	assert.Equal(t, repository.ErrProviderNotFound, err)
+	now = now.Add(time.Minute)
+	_, err = service.Lookup("casino")
+	assert.NoError(t, err)
+
+	// a failed reload keeps serving the stale copy
+	repo.err = errors.New("connection refused")
+	now = now.Add(time.Minute)
+	_, err = service.Lookup("casino")
+	assert.NoError(t, err)
+
+	// without a copy the failure is reported
+	service.Invalidate()
+	_, err = service.Lookup("casino")
+	assert.Error(t, err)
+}
+
+func TestProviderServiceRejectsInvalidChanges(t *testing.T) {
+	repo := &providerRepo{providers: map[string]models.Provider{"game": models.DefaultProvider("game")}}
+	service := NewProviderService(repo, time.Minute)
+
+	_, err := service.UpdateProvider("game", &models.ProviderRequest{AllowedStates: []string{}})
+	var validationErr *models.ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	_, err = service.CreateProvider(&models.ProviderRequest{Name: "Not Valid"})
+	assert.True(t, errors.As(err, &validationErr))
+	_, err = service.UpdateProvider("casino", &models.ProviderRequest{})
+	assert.Equal(t, repository.ErrProviderNotFound, err)
+}
+
+func TestStaticProviders(t *testing.T) {
+	registry := NewStaticProviders([]models.Provider{models.DefaultProvider("game")})
+	provider, err := registry.Lookup("game")
+	assert.NoError(t, err)
+	assert.Equal(t, "game", provider.Name)
+	_, err = registry.Lookup("player")
+	assert.Equal(t, repository.ErrProviderNotFound, err)
+	secrets, err := registry.Secrets("player")
+	assert.NoError(t, err)
+	assert.Empty(t, secrets)
+}
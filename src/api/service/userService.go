@@ -1,30 +1,262 @@
 package service
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
 	"github.com/myrachanto/entaingo/src/api/models"
 	"github.com/myrachanto/entaingo/src/api/repository"
 )
 
+// cancelJobLease names the lease that makes a replica the one running CancelOddTransactions
+const cancelJobLease = "cancel-odd-transactions"
+
+// oddCancelBatch is how many of the latest odd transactions each run cancels
+const oddCancelBatch = 10
+
 var (
 	UserService UserServiceInterface = &userService{}
 )
 
 type UserServiceInterface interface {
 	Create(transaction *models.TransactionRequest) (*models.UserInfo, error)
-	GetTransactions(userId int) (*models.UserInfo, error)
+	CreateBatch(userId uint, atomic bool, items []models.BatchItem) (*models.BatchResult, error)
+	GetTransactions(filter *models.TransactionFilter) (*models.UserInfo, error)
+	ExportTransactions(ctx context.Context, filter *models.ExportFilter, fn func(row models.ExportRow) error) error
+	GetTransactionStatus(transactionId string) (*models.TransactionStatus, error)
+	CancelTransaction(transactionId string, reason string) (*models.UserInfo, error)
+	CancelOddTransactions(ctx context.Context, wg *sync.WaitGroup, elector repository.LeaderElector)
+	ReconcileUser(userId uint) (*models.LedgerCheck, error)
+	CreateUser(userReq *models.UserRequest) (*models.User, error)
+	OpenWallet(userId uint, currency string) (*models.Wallet, error)
+	GetUser(userId uint) (*models.User, error)
+	BalanceAt(userId uint, at time.Time) (*models.BalanceAsOf, error)
+	UpdateUserStatus(userId uint, status string) (*models.User, error)
+	SubscribeBalance(userId uint, lastSeq uint64, resume bool) (*Subscription, error)
 }
 type userService struct {
-	repo repository.UserrepoInterface
+	repo   repository.UserrepoInterface
+	events *BalanceBroker
 }
 
-func NewUserService(repository repository.UserrepoInterface) UserServiceInterface {
+// NewUserService follows the users' balance changes through events, waking it after each write
+func NewUserService(repository repository.UserrepoInterface, events *BalanceBroker) UserServiceInterface {
 	return &userService{
 		repository,
+		events,
 	}
 }
 func (service *userService) Create(transaction *models.TransactionRequest) (*models.UserInfo, error) {
-	return service.repo.Create(transaction)
+	res, err := service.repo.Create(transaction)
+	if err != nil {
+		return nil, err
+	}
+	// a replay changed nothing, its event went out the first time
+	if !res.Replayed {
+		service.events.Wake()
+	}
+	return res, nil
+}
+func (service *userService) CreateBatch(userId uint, atomic bool, items []models.BatchItem) (*models.BatchResult, error) {
+	res, err := service.repo.CreateBatch(userId, atomic, items)
+	if err != nil || !res.Committed {
+		return res, err
+	}
+	service.events.Wake()
+	return res, nil
+}
+
+// SubscribeBalance follows the balance events of an existing user, resuming after lastSeq when resume is set
+func (service *userService) SubscribeBalance(userId uint, lastSeq uint64, resume bool) (*Subscription, error) {
+	if _, err := service.repo.GetUser(userId); err != nil {
+		return nil, err
+	}
+	return service.events.Subscribe(userId, lastSeq, resume)
+}
+func (service *userService) GetTransactions(filter *models.TransactionFilter) (*models.UserInfo, error) {
+	return service.repo.GetTransactions(filter)
+}
+func (service *userService) ExportTransactions(ctx context.Context, filter *models.ExportFilter, fn func(row models.ExportRow) error) error {
+	return service.repo.ExportTransactions(ctx, filter, fn)
+}
+
+// GetTransactionStatus looks a transaction up by the provider's transactionId, with the user it affected
+func (service *userService) GetTransactionStatus(transactionId string) (*models.TransactionStatus, error) {
+	transaction, err := service.repo.FindTransaction(transactionId)
+	if err != nil {
+		return nil, err
+	}
+	user, err := service.repo.GetUser(transaction.UserID)
+	if err != nil {
+		return nil, err
+	}
+	status := models.TransactionStatusProcessed
+	if transaction.Canceled {
+		status = models.TransactionStatusCanceled
+	}
+	return &models.TransactionStatus{
+		Transaction: *transaction,
+		Status:      status,
+		User:        *user,
+	}, nil
+}
+func (service *userService) ReconcileUser(userId uint) (*models.LedgerCheck, error) {
+	return service.repo.ReconcileUser(userId)
+}
+func (service *userService) CreateUser(userReq *models.UserRequest) (*models.User, error) {
+	return service.repo.CreateUser(userReq)
+}
+func (service *userService) OpenWallet(userId uint, currency string) (*models.Wallet, error) {
+	return service.repo.OpenWallet(userId, currency)
+}
+func (service *userService) GetUser(userId uint) (*models.User, error) {
+	return service.repo.GetUser(userId)
+}
+func (service *userService) BalanceAt(userId uint, at time.Time) (*models.BalanceAsOf, error) {
+	return service.repo.BalanceAt(userId, at)
+}
+func (service *userService) UpdateUserStatus(userId uint, status string) (*models.User, error) {
+	return service.repo.UpdateUserStatus(userId, status)
+}
+
+// reversal is the balance change that undoes a transaction.
+// Manual cancellations and the odd transaction job both reverse through it.
+func reversal(transaction models.Transaction) models.Money {
+	switch transaction.State {
+	case "win":
+		return -transaction.Amount
+	case "lost":
+		return transaction.Amount
+	}
+	return 0
+}
+
+// CancelTransaction reverses a transaction by its provider transactionId on behalf of support staff
+func (service *userService) CancelTransaction(transactionId string, reason string) (*models.UserInfo, error) {
+	if !models.ValidManualCancelReason(reason) {
+		return nil, repository.ErrInvalidCancelReason
+	}
+	transaction, err := service.repo.FindTransaction(transactionId)
+	if err != nil {
+		return nil, err
+	}
+	if transaction.Canceled {
+		return nil, repository.ErrAlreadyCanceled
+	}
+	res, err := service.repo.CancelTransaction(transaction.ID, reason, reversal(*transaction))
+	if err != nil {
+		return nil, err
+	}
+	service.events.Wake()
+	return res, nil
 }
-func (service *userService) GetTransactions(userId int) (*models.UserInfo, error) {
-	return service.repo.GetTransactions(userId)
+
+// CancelOddTransactions cancels the 10 latest odd transactions every OddCancelInterval minutes.
+// Every replica runs the ticker, but only the one holding the job lease does the work.
+func (service *userService) CancelOddTransactions(ctx context.Context, wg *sync.WaitGroup, elector repository.LeaderElector) {
+	defer wg.Done()
+	log.Println("CancelOddTransactions started ....")
+
+	// Load environment variables
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file in routes ", err)
+	}
+
+	OddCancelInterval := os.Getenv("OddCancelInterval")
+	OddInterval, err := strconv.ParseUint(OddCancelInterval, 10, 32)
+	if err != nil {
+		log.Fatal("failed to parse the odd Interval ", err)
+	}
+
+	interval := time.Minute * time.Duration(OddInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// the leader renews every tick, the lease outlives a late tick but not a dead leader for long
+	leaseTTL := 2 * interval
+	defer func() {
+		if err := elector.Release(context.Background(), cancelJobLease); err != nil {
+			log.Println("Failed to release the job lease: ", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			leader, err := elector.Acquire(ctx, cancelJobLease, leaseTTL)
+			if err != nil {
+				log.Println("Failed to acquire the job lease: ", err)
+				continue
+			}
+			if !leader {
+				log.Println("another replica holds the job lease, skipping cancellation")
+				continue
+			}
+			log.Println("N odd time cancellation initialized")
+			run := service.cancelOddTransactions()
+			if err := service.repo.SaveCancellationRun(run); err != nil {
+				log.Println("Failed to record cancellation run: ", err)
+			}
+
+		case <-ctx.Done():
+			log.Println("CancelOddTransactions gracefully shutting down...")
+			return
+		}
+	}
+}
+
+// cancelOddTransactions runs the job once. Each cancellation commits or rolls back on its own,
+// so one failure doesn't undo the others; failures are recorded as skipped with their reason.
+func (service *userService) cancelOddTransactions() *models.CancellationRun {
+	run := &models.CancellationRun{
+		StartedAt:    time.Now(),
+		CandidateIDs: []uint{},
+		CanceledIDs:  []uint{},
+		Skipped:      []models.SkippedTransaction{},
+		Impact:       []models.BalanceImpact{},
+	}
+	defer func() {
+		run.FinishedAt = time.Now()
+	}()
+
+	transactions, err := service.repo.OddCancellationCandidates(oddCancelBatch)
+	if err != nil {
+		log.Println("Error fetching transactions: ", err)
+		run.Error = fmt.Sprintf("failed to fetch transactions: %v", err)
+		return run
+	}
+
+	impact := map[models.BalanceImpact]models.Money{}
+	order := []models.BalanceImpact{}
+	for _, transaction := range transactions {
+		run.CandidateIDs = append(run.CandidateIDs, transaction.ID)
+		delta := reversal(transaction)
+		_, err := service.repo.CancelTransaction(transaction.ID, models.CancelReasonOddJob, delta)
+		if err != nil {
+			run.Skipped = append(run.Skipped, models.SkippedTransaction{ID: transaction.ID, Reason: err.Error()})
+			log.Printf("skipped transaction %d: %s", transaction.ID, err)
+			continue
+		}
+		service.events.Wake()
+		run.CanceledIDs = append(run.CanceledIDs, transaction.ID)
+
+		// net the reversals per user wallet
+		key := models.BalanceImpact{UserID: transaction.UserID, Currency: transaction.Currency}
+		if _, ok := impact[key]; !ok {
+			order = append(order, key)
+		}
+		impact[key] += delta
+	}
+	for _, key := range order {
+		key.Amount = impact[key]
+		run.Impact = append(run.Impact, key)
+	}
+	log.Printf("canceled %d odd transactions, skipped %d", len(run.CanceledIDs), len(run.Skipped))
+	return run
 }
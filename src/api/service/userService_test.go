@@ -0,0 +1,31 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchRepo answers CreateBatch with a fixed result, other methods aren't used
+type batchRepo struct {
+	repository.UserrepoInterface
+	result *models.BatchResult
+}
+
+func (r batchRepo) CreateBatch(userId uint, atomic bool, items []models.BatchItem) (*models.BatchResult, error) {
+	return r.result, nil
+}
+
+func TestCreateBatchWakesBalanceEvents(t *testing.T) {
+	broker := NewBalanceBroker(NewMemoryEvents(), 10)
+
+	_, err := NewUserService(batchRepo{result: &models.BatchResult{Committed: false}}, broker).CreateBatch(1, true, nil)
+	assert.NoError(t, err)
+	assert.Len(t, broker.wake, 0, "a rolled back batch changed no balance")
+
+	_, err = NewUserService(batchRepo{result: &models.BatchResult{Committed: true}}, broker).CreateBatch(1, false, nil)
+	assert.NoError(t, err)
+	assert.Len(t, broker.wake, 1, "the applied items are read back from the journal at once")
+}
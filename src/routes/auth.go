@@ -0,0 +1,285 @@
+package routes
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/rpc"
+	"github.com/myrachanto/entaingo/src/api/service"
+)
+
+// roles a token can carry
+const (
+	RolePlayer  = "player"  // reads its own account, the one named in sub
+	RoleSupport = "support" // staff, reads every account
+	RoleAdmin   = "admin"   // staff, reads every account
+)
+
+// error codes of rejected tokens
+const (
+	codeUnauthenticated = "unauthenticated"
+	codeForbidden       = "forbidden"
+)
+
+// claimsKey is where Authenticated keeps the verified claims of a request
+const claimsKey = "claims"
+
+// tokenLeeway absorbs clock skew between the token issuer and the API
+const tokenLeeway = 30 * time.Second
+
+// signingMethods are the algorithms tokens may be signed with, all asymmetric so the API holds no signing key
+var signingMethods = []string{"RS256", "ES256", "EdDSA"}
+
+// Claims identify who a token was issued to: the user in sub for players, or a staff role
+type Claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// UserID is the account a player token was issued for, 0 for staff tokens without one
+func (c *Claims) UserID() uint {
+	id, err := strconv.ParseUint(c.Subject, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint(id)
+}
+
+// Staff reports whether the token may read every account
+func (c *Claims) Staff() bool {
+	return c.Role == RoleSupport || c.Role == RoleAdmin
+}
+
+// KeySet verifies tokens against the public keys of the issuer, by the key id in the token's kid header
+type KeySet struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// NewKeySet verifies tokens signed with keys, and issued by issuer for audience when they are set
+func NewKeySet(keys map[string]crypto.PublicKey, issuer, audience string) *KeySet {
+	return &KeySet{keys: keys, issuer: issuer, audience: audience}
+}
+
+// NewEnvKeys reads the verification keys from JWT_PUBLIC_KEYS, a comma separated list of
+// <kid>=<path to a PEM public key>, and the expected issuer and audience from JWT_ISSUER and JWT_AUDIENCE.
+// Listing a new key next to the old one rotates keys without rejecting tokens already issued.
+func NewEnvKeys() (*KeySet, error) {
+	keys := map[string]crypto.PublicKey{}
+	for _, entry := range strings.Split(os.Getenv("JWT_PUBLIC_KEYS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		kid, path, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT_PUBLIC_KEYS entry %q, expected <kid>=<path>", entry)
+		}
+		key, err := readPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the key %s %w", kid, err)
+		}
+		keys[kid] = key
+	}
+	return NewKeySet(keys, os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE")), nil
+}
+
+// readPublicKey reads an RSA, ECDSA or Ed25519 public key from a PEM file
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// Len is the number of keys tokens are verified against
+func (k *KeySet) Len() int {
+	return len(k.keys)
+}
+
+// Verify checks the signature, expiry, issuer and audience of token and returns its claims
+func (k *KeySet) Verify(token string) (*Claims, error) {
+	options := []jwt.ParserOption{jwt.WithValidMethods(signingMethods), jwt.WithExpirationRequired(), jwt.WithLeeway(tokenLeeway)}
+	if k.issuer != "" {
+		options = append(options, jwt.WithIssuer(k.issuer))
+	}
+	if k.audience != "" {
+		options = append(options, jwt.WithAudience(k.audience))
+	}
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return key, nil
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case claims.Staff():
+	case claims.Role == RolePlayer && claims.UserID() != 0:
+	default:
+		return nil, errors.New("token names neither a player nor a staff role")
+	}
+	return claims, nil
+}
+
+// VerifyCaller verifies token for the gRPC API, which holds calls to the same rules
+func (k *KeySet) VerifyCaller(token string) (rpc.Caller, error) {
+	claims, err := k.Verify(token)
+	if err != nil {
+		return rpc.Caller{}, err
+	}
+	return rpc.Caller{UserID: claims.UserID(), Staff: claims.Staff()}, nil
+}
+
+// Authenticated rejects requests without a valid bearer token and keeps the token's claims for the
+// authorization checks after it
+func Authenticated(keys *KeySet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			rejectToken(c, "missing bearer token")
+			return
+		}
+		claims, err := keys.Verify(token)
+		if err != nil {
+			rejectToken(c, "invalid token")
+			return
+		}
+		c.Set(claimsKey, claims)
+	}
+}
+
+// OwnerOrStaff lets staff through, and players only to the account userID reads from the request.
+// A request naming no account is for staff only.
+func OwnerOrStaff(userID func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := requestClaims(c)
+		if claims.Staff() {
+			return
+		}
+		id, err := strconv.ParseUint(userID(c), 10, 32)
+		if err != nil || uint(id) != claims.UserID() {
+			forbid(c)
+		}
+	}
+}
+
+// StaffOnly lets only staff through
+func StaffOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !requestClaims(c).Staff() {
+			forbid(c)
+		}
+	}
+}
+
+// SignedOrStaff accepts either a request signed by a provider enabled in providers or a staff token,
+// for the requests providers make as well as support
+func SignedOrStaff(signed, authenticated gin.HandlerFunc, providers service.ProviderLookup) gin.HandlerFunc {
+	staff := StaffOnly()
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			if signed(c); !c.IsAborted() {
+				enabledProvider(c, providers)
+			}
+			return
+		}
+		if authenticated(c); !c.IsAborted() {
+			staff(c)
+		}
+	}
+}
+
+// enabledProvider rejects a request signed by a provider that was disabled, or removed, since it got its secret
+func enabledProvider(c *gin.Context, providers service.ProviderLookup) {
+	provider, err := providers.Lookup(c.GetHeader("Source-Type"))
+	if err != nil && !errors.Is(err, repository.ErrProviderNotFound) {
+		unavailable(c, err)
+		return
+	}
+	if err != nil || !provider.Enabled {
+		disabled := repository.ErrProviderDisabled
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": disabled.Error(), "code": disabled.Code})
+	}
+}
+
+// Param reads the account from a path parameter
+func Param(name string) func(c *gin.Context) string {
+	return func(c *gin.Context) string { return c.Param(name) }
+}
+
+// Query reads the account from a query parameter
+func Query(name string) func(c *gin.Context) string {
+	return func(c *gin.Context) string { return c.Query(name) }
+}
+
+// requestClaims are the claims Authenticated verified, empty when it didn't run
+func requestClaims(c *gin.Context) *Claims {
+	if claims, ok := c.Get(claimsKey); ok {
+		return claims.(*Claims)
+	}
+	return &Claims{}
+}
+
+func rejectToken(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", `Bearer realm="entaingo"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message, "code": codeUnauthenticated})
+}
+
+func forbid(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not allowed for this token", "code": codeForbidden})
+}
+
+// TokenSigner issues tokens offline with a key of its own, for tests and local runs without an identity provider
+type TokenSigner struct {
+	kid string
+	key ed25519.PrivateKey
+}
+
+// NewTokenSigner signs with a fresh Ed25519 key under kid
+func NewTokenSigner(kid string) (*TokenSigner, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenSigner{kid: kid, key: key}, nil
+}
+
+// Keys verifies the tokens of the signer
+func (s *TokenSigner) Keys() *KeySet {
+	return NewKeySet(map[string]crypto.PublicKey{s.kid: s.key.Public()}, "", "")
+}
+
+// Sign issues a token for role, naming the account userID when it isn't 0, valid for ttl
+func (s *TokenSigner) Sign(role string, userID uint, ttl time.Duration) (string, error) {
+	claims := Claims{Role: role, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl))}}
+	if userID != 0 {
+		claims.Subject = strconv.FormatUint(uint64(userID), 10)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = s.kid
+	return token.SignedString(s.key)
+}
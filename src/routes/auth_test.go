@@ -0,0 +1,198 @@
+package routes
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/myrachanto/entaingo/src/api/controller"
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/rpc"
+	"github.com/myrachanto/entaingo/src/api/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	signer, err := NewTokenSigner("current")
+	assert.NoError(t, err)
+	other, err := NewTokenSigner("current")
+	assert.NoError(t, err)
+	renamed, err := NewTokenSigner("retired")
+	assert.NoError(t, err)
+	sign := func(s *TokenSigner, role string, userID uint, ttl time.Duration) string {
+		token, err := s.Sign(role, userID, ttl)
+		assert.NoError(t, err)
+		return "Bearer " + token
+	}
+
+	router := gin.New()
+	authenticated := Authenticated(signer.Keys())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/users/:id", authenticated, OwnerOrStaff(Param("id")), ok)
+	router.GET("/transactions/export", authenticated, OwnerOrStaff(Query("userId")), ok)
+	router.GET("/jobs/cancellations", authenticated, StaffOnly(), ok)
+
+	tests := []struct {
+		name           string
+		path           string
+		authorization  string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"player reads their own account", "/users/7", sign(signer, RolePlayer, 7, time.Minute), http.StatusOK, ""},
+		{"player reads another account", "/users/8", sign(signer, RolePlayer, 7, time.Minute), http.StatusForbidden, codeForbidden},
+		{"player reads a malformed account", "/users/abc", sign(signer, RolePlayer, 7, time.Minute), http.StatusForbidden, codeForbidden},
+		{"support reads any account", "/users/8", sign(signer, RoleSupport, 0, time.Minute), http.StatusOK, ""},
+		{"admin reads any account", "/users/8", sign(signer, RoleAdmin, 0, time.Minute), http.StatusOK, ""},
+		{"player exports their own transactions", "/transactions/export?userId=7", sign(signer, RolePlayer, 7, time.Minute), http.StatusOK, ""},
+		{"player exports every user", "/transactions/export", sign(signer, RolePlayer, 7, time.Minute), http.StatusForbidden, codeForbidden},
+		{"staff exports every user", "/transactions/export", sign(signer, RoleSupport, 0, time.Minute), http.StatusOK, ""},
+		{"player reads a staff resource", "/jobs/cancellations", sign(signer, RolePlayer, 7, time.Minute), http.StatusForbidden, codeForbidden},
+		{"staff reads a staff resource", "/jobs/cancellations", sign(signer, RoleAdmin, 0, time.Minute), http.StatusOK, ""},
+		{"missing token", "/users/7", "", http.StatusUnauthorized, codeUnauthenticated},
+		{"not a bearer token", "/users/7", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, codeUnauthenticated},
+		{"malformed token", "/users/7", "Bearer not-a-jwt", http.StatusUnauthorized, codeUnauthenticated},
+		{"expired token", "/users/7", sign(signer, RolePlayer, 7, -time.Hour), http.StatusUnauthorized, codeUnauthenticated},
+		{"signed with another key", "/users/7", sign(other, RolePlayer, 7, time.Minute), http.StatusUnauthorized, codeUnauthenticated},
+		{"unknown key id", "/users/7", sign(renamed, RolePlayer, 7, time.Minute), http.StatusUnauthorized, codeUnauthenticated},
+		{"player without an account", "/users/7", sign(signer, RolePlayer, 0, time.Minute), http.StatusUnauthorized, codeUnauthenticated},
+		{"unknown role", "/users/7", sign(signer, "provider", 7, time.Minute), http.StatusUnauthorized, codeUnauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedCode != "" {
+				assert.Contains(t, w.Body.String(), `"code":"`+tt.expectedCode+`"`)
+			}
+			if tt.expectedStatus == http.StatusUnauthorized {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestSignedOrStaff(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	signer, err := NewTokenSigner("test")
+	assert.NoError(t, err)
+	signed := Signed(staticSecrets{"game": {"secret"}, "retired": {"secret"}}, repository.NewMemoryNonces(), 5*time.Minute)
+	providers := service.NewStaticProviders([]models.Provider{models.DefaultProvider("game"), {Name: "retired"}})
+	router := gin.New()
+	var provider string
+	router.GET("/transactions/external/:transactionId", SignedOrStaff(signed, Authenticated(signer.Keys()), providers), func(c *gin.Context) {
+		provider = c.GetString(controller.SignedProviderKey)
+		c.Status(http.StatusOK)
+	})
+	send := func(header func(req *http.Request)) int {
+		req, _ := http.NewRequest(http.MethodGet, "/transactions/external/tx1", http.NoBody)
+		header(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	bearer := func(role string, userID uint) func(req *http.Request) {
+		token, _ := signer.Sign(role, userID, time.Minute)
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	signedBy := func(source, nonce string) func(req *http.Request) {
+		return func(req *http.Request) {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set("Source-Type", source)
+			req.Header.Set(TimestampHeader, timestamp)
+			req.Header.Set(NonceHeader, nonce)
+			req.Header.Set(SignatureHeader, Sign("secret", req, nil))
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, send(signedBy("game", "n-1")), "providers sign their status checks")
+	assert.Equal(t, "game", provider, "the handler knows which provider signed")
+	assert.Equal(t, http.StatusConflict, send(signedBy("retired", "n-2")), "a disabled provider's secret no longer lets it in")
+	provider = ""
+	assert.Equal(t, http.StatusOK, send(bearer(RoleSupport, 0)), "staff use their token")
+	assert.Empty(t, provider)
+	assert.Equal(t, http.StatusForbidden, send(bearer(RolePlayer, 7)), "players can't look transactions up")
+	assert.Equal(t, http.StatusUnauthorized, send(func(req *http.Request) {}), "anonymous requests are rejected")
+}
+
+func TestEnvKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "issuer.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	t.Setenv("JWT_PUBLIC_KEYS", "2024-10="+path)
+	t.Setenv("JWT_ISSUER", "https://id.entaingo.test")
+	t.Setenv("JWT_AUDIENCE", "entaingo")
+	keys, err := NewEnvKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, keys.Len())
+
+	sign := func(issuer string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, Claims{Role: RolePlayer, RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "7",
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{"entaingo"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		}})
+		token.Header["kid"] = "2024-10"
+		signed, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return signed
+	}
+	claims, err := keys.Verify(sign("https://id.entaingo.test"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint(7), claims.UserID())
+	_, err = keys.Verify(sign("https://elsewhere.test"))
+	assert.Error(t, err, "tokens of another issuer are rejected")
+
+	t.Setenv("JWT_PUBLIC_KEYS", "2024-10")
+	_, err = NewEnvKeys()
+	assert.Error(t, err)
+	t.Setenv("JWT_PUBLIC_KEYS", "2024-10="+filepath.Join(t.TempDir(), "missing.pem"))
+	_, err = NewEnvKeys()
+	assert.Error(t, err)
+}
+
+func TestVerifyCaller(t *testing.T) {
+	signer, err := NewTokenSigner("test")
+	assert.NoError(t, err)
+	keys := signer.Keys()
+
+	player, _ := signer.Sign(RolePlayer, 7, time.Minute)
+	caller, err := keys.VerifyCaller(player)
+	assert.NoError(t, err)
+	assert.Equal(t, rpc.Caller{UserID: 7}, caller)
+
+	staff, _ := signer.Sign(RoleAdmin, 0, time.Minute)
+	caller, err = keys.VerifyCaller(staff)
+	assert.NoError(t, err)
+	assert.Equal(t, rpc.Caller{Staff: true}, caller)
+
+	expired, _ := signer.Sign(RoleAdmin, 0, -time.Hour)
+	_, err = keys.VerifyCaller(expired)
+	assert.Error(t, err)
+}
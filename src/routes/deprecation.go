@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deprecated marks responses of a deprecated route family with a Deprecation header
+// and a Link to the same route under the successor prefix, e.g. /api/v1
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+successor+strings.TrimSuffix(c.Request.URL.Path, "/")+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
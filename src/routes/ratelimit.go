@@ -0,0 +1,285 @@
+package routes
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/service"
+)
+
+// codeRateLimited is the error code of requests over their rate
+const codeRateLimited = "rate_limited"
+
+// limits applied when RATE_LIMIT_* isn't set
+var (
+	defaultProviderRate = Rate{PerSecond: 50, Burst: 100}
+	defaultIPRate       = Rate{PerSecond: 20, Burst: 40}
+)
+
+// pruneEvery is how often buckets that have refilled are dropped, a refilled bucket is the same as a new one
+const pruneEvery = time.Minute
+
+// maxStatsKeys caps the keys listed in the stats of a limiter, the most rejected first
+const maxStatsKeys = 20
+
+// Rate is a token bucket: PerSecond tokens are added every second, up to Burst. A rate of 0 is unlimited.
+type Rate struct {
+	PerSecond float64 `json:"per_second"`
+	Burst     int     `json:"burst"`
+}
+
+// burst is the size of the bucket, at least one request and, when unset, a second's worth
+func (r Rate) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.PerSecond))
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	full     time.Time // when the bucket will have refilled if left alone
+	allowed  uint64
+	rejected uint64
+}
+
+// Limiter keeps a token bucket per key, such as a provider or a client IP
+type Limiter struct {
+	name      string
+	now       func() time.Time
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	allowed   uint64
+	rejected  uint64
+	lastPrune time.Time
+}
+
+// NewLimiter keeps the buckets of the keys it is asked about, reported in its stats under name
+func NewLimiter(name string) *Limiter {
+	return &Limiter{
+		name:    name,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the bucket of key, filled at rate. Without a token left it returns
+// false and how long until the next one.
+func (l *Limiter) Allow(key string, rate Rate) (bool, time.Duration) {
+	if rate.PerSecond <= 0 {
+		return true, 0
+	}
+	burst := rate.burst()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	// a lowered burst applies at once to a bucket fuller than it
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond)
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+		b.allowed++
+		l.allowed++
+	} else {
+		b.rejected++
+		l.rejected++
+	}
+	b.full = now.Add(seconds((burst - b.tokens) / rate.PerSecond))
+	if allowed {
+		return true, 0
+	}
+	return false, seconds((1 - b.tokens) / rate.PerSecond)
+}
+
+// prune drops the buckets that have refilled, so keys seen once, such as passing IPs, don't pile up
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneEvery {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// LimiterStats count the requests a limiter let through and rejected since the server started
+type LimiterStats struct {
+	Name     string     `json:"name"`
+	Allowed  uint64     `json:"allowed"`
+	Rejected uint64     `json:"rejected"`
+	Tracked  int        `json:"tracked"` // keys with a bucket that hasn't refilled yet
+	Keys     []KeyStats `json:"keys"`    // the most rejected keys first
+}
+
+// KeyStats are the counts of one key since its bucket was last refilled
+type KeyStats struct {
+	Key      string  `json:"key"`
+	Tokens   float64 `json:"tokens"`
+	Allowed  uint64  `json:"allowed"`
+	Rejected uint64  `json:"rejected"`
+}
+
+// Stats reports the counts of the limiter and of its most rejected keys
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := LimiterStats{Name: l.name, Allowed: l.allowed, Rejected: l.rejected, Tracked: len(l.buckets), Keys: []KeyStats{}}
+	for key, b := range l.buckets {
+		stats.Keys = append(stats.Keys, KeyStats{Key: key, Tokens: math.Floor(b.tokens*100) / 100, Allowed: b.allowed, Rejected: b.rejected})
+	}
+	sort.Slice(stats.Keys, func(i, j int) bool {
+		if stats.Keys[i].Rejected != stats.Keys[j].Rejected {
+			return stats.Keys[i].Rejected > stats.Keys[j].Rejected
+		}
+		return stats.Keys[i].Key < stats.Keys[j].Key
+	})
+	if len(stats.Keys) > maxStatsKeys {
+		stats.Keys = stats.Keys[:maxStatsKeys]
+	}
+	return stats
+}
+
+// RateLimiter holds providers and client IPs to their rates. A provider's rate comes from the
+// registry when set there, else from the default provider rate; the defaults can be reloaded.
+type RateLimiter struct {
+	providers  service.ProviderLookup
+	mu         sync.RWMutex
+	provider   Rate
+	ip         Rate
+	byProvider *Limiter
+	byIP       *Limiter
+}
+
+// NewRateLimiter reads the default rates from the environment, see Reload
+func NewRateLimiter(providers service.ProviderLookup) (*RateLimiter, error) {
+	limiter := &RateLimiter{
+		providers:  providers,
+		byProvider: NewLimiter("provider"),
+		byIP:       NewLimiter("ip"),
+	}
+	if err := limiter.Reload(os.Getenv); err != nil {
+		return nil, err
+	}
+	return limiter, nil
+}
+
+// Reload reads the default provider rate from RATE_LIMIT_PROVIDER and RATE_LIMIT_PROVIDER_BURST, and the
+// client IP rate from RATE_LIMIT_IP and RATE_LIMIT_IP_BURST, in requests per second. Buckets keep their
+// tokens, so new rates apply from the next request. On an invalid value the current rates are kept.
+func (r *RateLimiter) Reload(env func(key string) string) error {
+	provider, err := parseRate(env, "RATE_LIMIT_PROVIDER", defaultProviderRate)
+	if err != nil {
+		return err
+	}
+	ip, err := parseRate(env, "RATE_LIMIT_IP", defaultIPRate)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.provider, r.ip = provider, ip
+	return nil
+}
+
+// parseRate reads a rate from key and key_BURST, fallback when key isn't set
+func parseRate(env func(key string) string, key string, fallback Rate) (Rate, error) {
+	value := env(key)
+	if value == "" {
+		return fallback, nil
+	}
+	perSecond, err := strconv.ParseFloat(value, 64)
+	if err != nil || perSecond < 0 || math.IsNaN(perSecond) || math.IsInf(perSecond, 0) {
+		return Rate{}, fmt.Errorf("invalid %s %q, expected requests per second", key, value)
+	}
+	rate := Rate{PerSecond: perSecond}
+	if burst := env(key + "_BURST"); burst != "" {
+		if rate.Burst, err = strconv.Atoi(burst); err != nil || rate.Burst < 0 {
+			return Rate{}, fmt.Errorf("invalid %s_BURST %q", key, burst)
+		}
+	}
+	return rate, nil
+}
+
+// providerRate is the rate of the named provider, its own when the registry sets one
+func (r *RateLimiter) providerRate(name string) Rate {
+	r.mu.RLock()
+	rate := r.provider
+	r.mu.RUnlock()
+	// an unknown provider or a failed lookup gets the default, its request is rejected further on anyway
+	if provider, err := r.providers.Lookup(name); err == nil && provider.RateLimit > 0 {
+		return Rate{PerSecond: provider.RateLimit, Burst: provider.RateBurst}
+	}
+	return rate
+}
+
+// PerIP holds every client IP to the IP rate
+func (r *RateLimiter) PerIP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r.mu.RLock()
+		rate := r.ip
+		r.mu.RUnlock()
+		if ok, wait := r.byIP.Allow(c.ClientIP(), rate); !ok {
+			tooManyRequests(c, wait)
+		}
+	}
+}
+
+// PerProvider holds the provider named in Source-Type to its rate. It goes after the signature check,
+// so requests merely claiming to be a provider can't use its rate up.
+func (r *RateLimiter) PerProvider() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, wait := r.AllowProvider(c.GetHeader("Source-Type")); !ok {
+			tooManyRequests(c, wait)
+		}
+	}
+}
+
+// AllowProvider takes a request from the provider's bucket, shared by its HTTP requests and gRPC calls
+func (r *RateLimiter) AllowProvider(provider string) (bool, time.Duration) {
+	return r.byProvider.Allow(provider, r.providerRate(provider))
+}
+
+// Stats godoc
+// @Summary Rate limiter stats
+// @Description The default rates and, per limiter, the requests let through and rejected since the server started with the most rejected providers or client IPs. Counts are per replica.
+// @Tags ratelimits
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]string "Missing or invalid bearer token"
+// @Failure 403 {object} map[string]string "Staff only"
+// @Security BearerAuth
+// @Router /ratelimits [get]
+func (r *RateLimiter) Stats(c *gin.Context) {
+	r.mu.RLock()
+	limits := gin.H{"provider": r.provider, "ip": r.ip}
+	r.mu.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"limits": limits, "limiters": []LimiterStats{r.byProvider.Stats(), r.byIP.Stats()}})
+}
+
+// tooManyRequests rejects a request over its rate, telling the client when to retry in whole seconds
+func tooManyRequests(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded", "code": codeRateLimited})
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/models"
+	"github.com/myrachanto/entaingo/src/api/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2024, 10, 22, 12, 0, 0, 0, time.UTC)
+	limiter := NewLimiter("test")
+	limiter.now = func() time.Time { return now }
+	rate := Rate{PerSecond: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.Allow("game", rate)
+		assert.True(t, ok, "the burst is let through")
+	}
+	ok, wait := limiter.Allow("game", rate)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait, "a token is added every half second")
+	ok, _ = limiter.Allow("server", rate)
+	assert.True(t, ok, "each key has its own bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = limiter.Allow("game", rate)
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("game", Rate{})
+	assert.True(t, ok, "a rate of 0 is unlimited")
+
+	stats := limiter.Stats()
+	assert.Equal(t, uint64(5), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	assert.Equal(t, 2, stats.Tracked)
+	assert.Equal(t, "game", stats.Keys[0].Key, "the most rejected key comes first")
+	assert.Equal(t, uint64(1), stats.Keys[0].Rejected)
+
+	// refilled buckets are dropped
+	now = now.Add(pruneEvery)
+	limiter.Allow("payment", rate)
+	assert.Equal(t, 1, limiter.Stats().Tracked)
+	assert.Equal(t, uint64(6), limiter.Stats().Allowed, "totals outlive the buckets")
+}
+
+func TestRateLimiterReload(t *testing.T) {
+	limiter, err := NewRateLimiter(service.NewStaticProviders(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultProviderRate, limiter.provider)
+	assert.Equal(t, defaultIPRate, limiter.ip)
+
+	env := map[string]string{"RATE_LIMIT_PROVIDER": "5", "RATE_LIMIT_PROVIDER_BURST": "10", "RATE_LIMIT_IP": "0.5"}
+	assert.NoError(t, limiter.Reload(func(key string) string { return env[key] }))
+	assert.Equal(t, Rate{PerSecond: 5, Burst: 10}, limiter.provider)
+	assert.Equal(t, Rate{PerSecond: 0.5}, limiter.ip)
+
+	for _, invalid := range []map[string]string{
+		{"RATE_LIMIT_IP": "fast"},
+		{"RATE_LIMIT_IP": "-1"},
+		{"RATE_LIMIT_IP": "NaN"},
+		{"RATE_LIMIT_PROVIDER": "+Inf"},
+		{"RATE_LIMIT_PROVIDER": "5", "RATE_LIMIT_PROVIDER_BURST": "1.5"},
+	} {
+		assert.Error(t, limiter.Reload(func(key string) string { return invalid[key] }))
+	}
+	assert.Equal(t, Rate{PerSecond: 5, Burst: 10}, limiter.provider, "invalid limits keep the current ones")
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	payment := models.DefaultProvider("payment")
+	payment.RateLimit, payment.RateBurst = 0.1, 1
+	limiter, err := NewRateLimiter(service.NewStaticProviders([]models.Provider{models.DefaultProvider("game"), payment}))
+	assert.NoError(t, err)
+	env := map[string]string{"RATE_LIMIT_PROVIDER": "1", "RATE_LIMIT_PROVIDER_BURST": "2", "RATE_LIMIT_IP": "1", "RATE_LIMIT_IP_BURST": "3"}
+	assert.NoError(t, limiter.Reload(func(key string) string { return env[key] }))
+
+	router := gin.New()
+	assert.NoError(t, router.SetTrustedProxies(nil))
+	router.Use(limiter.PerIP())
+	router.POST("/transaction", limiter.PerProvider(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/ratelimits", limiter.Stats)
+	send := func(ip, provider string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/transaction", nil)
+		req.RemoteAddr = ip + ":40000"
+		req.Header.Set("Source-Type", provider)
+		req.Header.Set("X-Forwarded-For", "203.0.113.99")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// the default provider rate lets a burst of 2 through
+	assert.Equal(t, http.StatusOK, send("10.0.0.1", "game").Code)
+	assert.Equal(t, http.StatusOK, send("10.0.0.2", "game").Code)
+	w := send("10.0.0.3", "game")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code":"`+codeRateLimited+`"`)
+
+	// the registry's rate of a provider replaces the default
+	assert.Equal(t, http.StatusOK, send("10.0.0.4", "payment").Code)
+	w = send("10.0.0.5", "payment")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+
+	// a client IP is limited whatever provider it names, and X-Forwarded-For of an untrusted peer is ignored
+	assert.Equal(t, http.StatusOK, send("10.0.0.9", "server-1").Code)
+	assert.Equal(t, http.StatusOK, send("10.0.0.9", "server-2").Code)
+	assert.Equal(t, http.StatusOK, send("10.0.0.9", "server-3").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.9", "server-4").Code)
+
+	req, _ := http.NewRequest(http.MethodGet, "/ratelimits", nil)
+	req.RemoteAddr = "10.0.1.1:40000"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Limits   map[string]Rate `json:"limits"`
+		Limiters []LimiterStats  `json:"limiters"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, Rate{PerSecond: 1, Burst: 3}, response.Limits["ip"])
+	assert.Equal(t, "provider", response.Limiters[0].Name)
+	assert.Equal(t, uint64(2), response.Limiters[0].Rejected)
+	assert.Equal(t, "ip", response.Limiters[1].Name)
+	assert.Equal(t, uint64(1), response.Limiters[1].Rejected)
+	assert.Equal(t, "10.0.0.9", response.Limiters[1].Keys[0].Key)
+}
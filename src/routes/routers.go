@@ -3,45 +3,86 @@ package routes
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/myrachanto/entaingo/docs"
 	"github.com/myrachanto/entaingo/src/api/controller"
+	"github.com/myrachanto/entaingo/src/api/models"
 	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/rpc"
 	"github.com/myrachanto/entaingo/src/api/service"
 	swaggerfiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"google.golang.org/grpc"
 )
 
+// apiV1 is the prefix of the current API contract
+const apiV1 = "/api/v1"
+
+// balanceEventHistory is how many missed balance events a resuming subscriber is replayed from the journal
+const balanceEventHistory = 100
+
+// providerCacheTTL is how long a replica serves its copy of the provider registry before rereading it,
+// so registry changes made through another replica take effect within it
+const providerCacheTTL = 30 * time.Second
+
+// defaultSignatureWindow is how far a signed request's timestamp may be from now when SIGNATURE_WINDOW isn't set
+const defaultSignatureWindow = 5 * time.Minute
+
 // var passer echo.MiddlewareFunc
 
 func ApiServer() {
-	// Test database connection
-	err := repository.IndexRepo.Dbsetup()
+	// Open the shared connection pool
+	db, err := repository.IndexRepo.Dbsetup()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	docs.SwaggerInfo.BasePath = "/api/v1"
-	userRepo := repository.NewUserRepo()
-	u := controller.NewUserController(service.NewUserService(userRepo))
-	router := gin.Default()
-	router.Use(gin.Logger())
-	router.Use(gin.Recovery())
-	router.Use(cors.Default())
+	docs.SwaggerInfo.BasePath = apiV1
+	userRepo := repository.NewUserRepo(db)
+	balanceEvents := service.NewBalanceBroker(userRepo, balanceEventHistory)
+	userService := service.NewUserService(userRepo, balanceEvents)
+	// the provider registry starts out as the default sources, signing with the secrets from .env
+	providerRepo := repository.NewProviderRepo(db)
+	if err := providerRepo.SeedProviders(seedProviders(NewEnvSecrets())); err != nil {
+		log.Fatal(err)
+	}
+	providers := service.NewProviderService(providerRepo, providerCacheTTL)
+	controller.Providers = providers
 
-	router.GET("/healthy", HealthCheck)
-	router.POST("/transaction", u.Create)
-	router.GET("/transaction/:id", u.GetTransactions)
-	// api documentation
-	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler))
+	u := controller.NewUserController(userService)
+	j := controller.NewJobController(service.NewJobService(repository.NewJobRepo(db)))
+	p := controller.NewProviderController(providers)
+	// money moving requests must be signed by their provider
+	nonces := repository.NewDbNonceStore(db)
+	signed := Signed(providers, nonces, signatureWindow())
+	// reads need a bearer token, players only reading their own account
+	keys, err := NewEnvKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if keys.Len() == 0 {
+		log.Println("JWT_PUBLIC_KEYS is not set, every authenticated read will be rejected")
+	}
+	// providers and client IPs are held to their rates, SIGHUP reloads the default rates from .env
+	limiter, err := NewRateLimiter(providers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	router := newRouter(u, j, p, providers, signed, Authenticated(keys), limiter)
+	if err := router.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatal(err)
+	}
 
 	err = godotenv.Load()
 	if err != nil {
@@ -49,9 +90,25 @@ func ApiServer() {
 	}
 
 	PORT := os.Getenv("PORT")
+	// request contexts end on shutdown, so event streams and exports don't hold the shutdown up
+	requests, endRequests := context.WithCancel(context.Background())
 	srv := &http.Server{
-		Addr:    PORT,
-		Handler: router,
+		Addr:        PORT,
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return requests },
+	}
+	srv.RegisterOnShutdown(endRequests)
+
+	// the gRPC API serves the same user service on its own port, its calls held to the rules of the HTTP API
+	GRPC_PORT := os.Getenv("GRPC_PORT")
+	grpcSrv := rpc.NewServer(userService, providers, grpc.ChainUnaryInterceptor(
+		rpc.Signed(providers, nonces, signatureWindow()),
+		rpc.Throttled(limiter),
+		rpc.Authenticated(keys),
+	))
+	lis, err := net.Listen("tcp", GRPC_PORT)
+	if err != nil {
+		log.Fatalf("grpc listen: %s\n", err)
 	}
 
 	// Create a cancellable context for graceful shutdown
@@ -60,8 +117,13 @@ func ApiServer() {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
-	// Launch CancelOddTransactions in a goroutine
-	go userRepo.CancelOddTransactions(ctx, wg)
+	// Launch CancelOddTransactions in a goroutine, only the replica holding the job lease runs it
+	elector := repository.NewDbLeaderElector(db, repository.HolderID())
+	go userService.CancelOddTransactions(ctx, wg, elector)
+
+	// every replica follows the shared journal for the balance event streams it serves
+	wg.Add(1)
+	go balanceEvents.Run(ctx, wg)
 
 	// Start the HTTP server in a goroutine
 	go func() {
@@ -70,6 +132,17 @@ func ApiServer() {
 		}
 	}()
 
+	// Start the gRPC server in a goroutine
+	go func() {
+		if err := grpcSrv.Serve(lis); err != nil {
+			log.Fatalf("grpc serve: %s\n", err)
+		}
+	}()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go reloadRateLimits(reload, limiter)
+
 	// Handle system signals for graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -83,9 +156,134 @@ func ApiServer() {
 	if err := srv.Shutdown(context.Background()); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
+	// GracefulStop waits for in-flight calls, which hold the pool until they finish
+	grpcSrv.GracefulStop()
 
 	// Wait for all goroutines to finish
 	wg.Wait()
 
+	// Release the connection pool once nothing uses it
+	repository.IndexRepo.DbClose(db)
+
 	log.Println("Server exited gracefully.")
 }
+
+// newRouter mounts the API under its version prefix. The unversioned paths the API was first
+// served on stay as deprecated aliases of v1 until providers have moved over.
+func newRouter(u controller.UserControllerInterface, j controller.JobControllerInterface, p controller.ProviderControllerInterface, providers service.ProviderLookup, signed, authenticated gin.HandlerFunc, limiter *RateLimiter) *gin.Engine {
+	router := gin.Default()
+	router.Use(gin.Logger())
+	router.Use(gin.Recovery())
+	// browsers may send the bearer token of the reads
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowAllOrigins = true
+	corsConfig.AddAllowHeaders("Authorization")
+	router.Use(cors.New(corsConfig))
+	router.Use(limiter.PerIP())
+
+	router.GET("/healthy", HealthCheck)
+	throttled := limiter.PerProvider()
+	// providers sign their requests, support sends a bearer token
+	providerOrStaff := SignedOrStaff(signed, authenticated, providers)
+	v1Routes(router.Group(apiV1), u, j, signed, throttled, authenticated, providerOrStaff)
+	v1Routes(router.Group("/", Deprecated(apiV1)), u, j, signed, throttled, authenticated, providerOrStaff)
+	// the provider registry and the limiter stats are administered under v1 only
+	providerRoutes(router.Group(apiV1), p, authenticated)
+	router.GET(apiV1+"/ratelimits", authenticated, StaffOnly(), limiter.Stats)
+	// api documentation
+	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler))
+	return router
+}
+
+// v1Routes registers the v1 contract on a router group, signed checks the requests that move money,
+// throttled holds their provider to its rate, authenticated checks the bearer token of the other requests
+// and providerOrStaff accepts either for the requests providers make as well as support
+func v1Routes(api *gin.RouterGroup, u controller.UserControllerInterface, j controller.JobControllerInterface, signed, throttled, authenticated, providerOrStaff gin.HandlerFunc) {
+	owner := OwnerOrStaff(Param("id"))
+	staff := StaffOnly()
+	api.POST("/transaction", signed, throttled, u.Create)
+	api.GET("/transaction/:id", authenticated, owner, u.GetTransactions)
+	api.POST("/transaction/:transactionId/cancel", authenticated, staff, u.CancelTransaction)
+	api.POST("/transactions/batch", signed, throttled, u.CreateBatch)
+	api.GET("/transactions/export", authenticated, OwnerOrStaff(Query("userId")), u.ExportTransactions)
+	api.GET("/transactions/external/:transactionId", providerOrStaff, u.GetTransactionStatus)
+	api.POST("/users", providerOrStaff, u.CreateUser)
+	api.GET("/users/:id", authenticated, owner, u.GetUser)
+	api.GET("/users/:id/balance", authenticated, owner, u.GetBalance)
+	api.GET("/users/:id/events", authenticated, owner, u.SubscribeBalance)
+	api.POST("/users/:id/wallets", providerOrStaff, u.OpenWallet)
+	api.GET("/users/:id/ledger", authenticated, staff, u.ReconcileUser)
+	api.PATCH("/users/:id/status", authenticated, staff, u.UpdateUserStatus)
+	api.GET("/jobs/cancellations", authenticated, staff, j.GetCancellationRuns)
+	api.GET("/jobs/cancellations/:runId", authenticated, staff, j.GetCancellationRun)
+}
+
+// providerRoutes registers the admin API of the provider registry, read and changed by staff only
+// since it holds the secrets providers sign with
+func providerRoutes(api *gin.RouterGroup, p controller.ProviderControllerInterface, authenticated gin.HandlerFunc) {
+	staff := StaffOnly()
+	api.GET("/providers", authenticated, staff, p.GetProviders)
+	api.POST("/providers", authenticated, staff, p.CreateProvider)
+	api.GET("/providers/:name", authenticated, staff, p.GetProvider)
+	api.PATCH("/providers/:name", authenticated, staff, p.UpdateProvider)
+	api.DELETE("/providers/:name", authenticated, staff, p.DeleteProvider)
+}
+
+// seedProviders are the default providers with their secrets, for a registry that is still empty
+func seedProviders(secrets SecretStore) []models.Provider {
+	providers := controller.DefaultProviders()
+	for i := range providers {
+		active, _ := secrets.Secrets(providers[i].Name)
+		if len(active) > 0 {
+			providers[i].Secret = active[0]
+		}
+		if len(active) > 1 {
+			providers[i].PreviousSecret = active[1]
+		}
+	}
+	return providers
+}
+
+// reloadRateLimits rereads the default rates from .env on every signal, RATE_LIMIT_* set in .env
+// taking precedence over the environment the server started with
+func reloadRateLimits(signals <-chan os.Signal, limiter *RateLimiter) {
+	for range signals {
+		values, err := godotenv.Read()
+		if err != nil {
+			log.Println("Failed to read .env, keeping the rate limits: ", err)
+			continue
+		}
+		err = limiter.Reload(func(key string) string {
+			if value, ok := values[key]; ok {
+				return value
+			}
+			return os.Getenv(key)
+		})
+		if err != nil {
+			log.Println("Failed to reload the rate limits, keeping the current ones: ", err)
+			continue
+		}
+		log.Println("Rate limits reloaded")
+	}
+}
+
+// trustedProxies reads the proxies whose X-Forwarded-For is believed from TRUSTED_PROXIES, a comma
+// separated list of IPs or CIDRs. Without it the client IP is the peer address, which can't be spoofed.
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// signatureWindow reads the replay window of signed requests from SIGNATURE_WINDOW, e.g. 5m
+func signatureWindow() time.Duration {
+	window, err := time.ParseDuration(os.Getenv("SIGNATURE_WINDOW"))
+	if err != nil || window <= 0 {
+		return defaultSignatureWindow
+	}
+	return window
+}
@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/controller"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/myrachanto/entaingo/src/api/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionedRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	signer, err := NewTokenSigner("test")
+	assert.NoError(t, err)
+	token, err := signer.Sign(RoleSupport, 0, time.Minute)
+	assert.NoError(t, err)
+	limiter, err := NewRateLimiter(service.NewStaticProviders(nil))
+	assert.NoError(t, err)
+	// the requests below fail validation before reaching a service
+	router := newRouter(controller.NewUserController(nil), controller.NewJobController(nil), controller.NewProviderController(nil), service.NewStaticProviders(controller.DefaultProviders()),
+		Signed(NewEnvSecrets(), repository.NewMemoryNonces(), time.Minute), Authenticated(signer.Keys()), limiter)
+
+	tests := []struct {
+		name               string
+		path               string
+		expectedStatus     int
+		expectedDeprecated bool
+		expectedLink       string
+	}{
+		{
+			name:           "v1 route",
+			path:           "/api/v1/transaction/abc",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:               "deprecated alias",
+			path:               "/transaction/abc",
+			expectedStatus:     http.StatusBadRequest,
+			expectedDeprecated: true,
+			expectedLink:       `</api/v1/transaction/abc>; rel="successor-version"`,
+		},
+		{
+			name:           "health check stays unversioned",
+			path:           "/healthy",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "unknown route",
+			path:           "/api/v2/transaction/1",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedDeprecated {
+				assert.Equal(t, "true", w.Header().Get("Deprecation"))
+				assert.Equal(t, test.expectedLink, w.Header().Get("Link"))
+			} else {
+				assert.Empty(t, w.Header().Get("Deprecation"))
+			}
+		})
+	}
+}
+
+func TestRouteAuthorization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	signer, err := NewTokenSigner("test")
+	assert.NoError(t, err)
+	limiter, err := NewRateLimiter(service.NewStaticProviders(nil))
+	assert.NoError(t, err)
+	// requests let through below fail validation before reaching a service
+	router := newRouter(controller.NewUserController(nil), controller.NewJobController(nil), controller.NewProviderController(nil), service.NewStaticProviders(controller.DefaultProviders()),
+		Signed(NewEnvSecrets(), repository.NewMemoryNonces(), time.Minute), Authenticated(signer.Keys()), limiter)
+	bearer := func(role string, userID uint) string {
+		token, err := signer.Sign(role, userID, time.Minute)
+		assert.NoError(t, err)
+		return "Bearer " + token
+	}
+	player, staff := bearer(RolePlayer, 7), bearer(RoleSupport, 0)
+	t.Setenv("SIGNING_SECRETS_GAME", "secret")
+	const signed = "signed by game"
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		authorization  string
+		expectedStatus int
+	}{
+		{"anonymous cancellation", http.MethodPost, "/api/v1/transaction/tx1/cancel", "", http.StatusUnauthorized},
+		{"player cancellation", http.MethodPost, "/api/v1/transaction/tx1/cancel", player, http.StatusForbidden},
+		{"staff cancellation", http.MethodPost, "/api/v1/transaction/tx1/cancel", staff, http.StatusBadRequest},
+		{"anonymous status change", http.MethodPatch, "/api/v1/users/7/status", "", http.StatusUnauthorized},
+		{"player closing their own account", http.MethodPatch, "/api/v1/users/7/status", player, http.StatusForbidden},
+		{"staff status change", http.MethodPatch, "/api/v1/users/7/status", staff, http.StatusBadRequest},
+		{"anonymous user creation", http.MethodPost, "/api/v1/users", "", http.StatusUnauthorized},
+		{"player user creation", http.MethodPost, "/api/v1/users", player, http.StatusForbidden},
+		{"staff user creation", http.MethodPost, "/api/v1/users", staff, http.StatusBadRequest},
+		{"provider user creation", http.MethodPost, "/api/v1/users", signed, http.StatusBadRequest},
+		{"anonymous wallet opening", http.MethodPost, "/api/v1/users/7/wallets", "", http.StatusUnauthorized},
+		{"player wallet opening", http.MethodPost, "/api/v1/users/7/wallets", player, http.StatusForbidden},
+		{"staff wallet opening", http.MethodPost, "/api/v1/users/7/wallets", staff, http.StatusBadRequest},
+		{"provider wallet opening", http.MethodPost, "/api/v1/users/7/wallets", signed, http.StatusBadRequest},
+		{"deprecated alias of a staff write", http.MethodPatch, "/users/7/status", "", http.StatusUnauthorized},
+		{"anonymous provider update", http.MethodPatch, "/api/v1/providers/game", "", http.StatusUnauthorized},
+		{"player provider update", http.MethodPatch, "/api/v1/providers/game", player, http.StatusForbidden},
+		{"staff provider update", http.MethodPatch, "/api/v1/providers/game", staff, http.StatusBadRequest},
+		{"anonymous provider registration", http.MethodPost, "/api/v1/providers", "", http.StatusUnauthorized},
+		{"player provider registration", http.MethodPost, "/api/v1/providers", player, http.StatusForbidden},
+		{"staff provider registration", http.MethodPost, "/api/v1/providers", staff, http.StatusBadRequest},
+		{"anonymous provider removal", http.MethodDelete, "/api/v1/providers/game", "", http.StatusUnauthorized},
+		{"player provider removal", http.MethodDelete, "/api/v1/providers/game", player, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest(test.method, test.path, bytes.NewBufferString("{"))
+			req.Header.Set("Content-Type", "application/json")
+			switch test.authorization {
+			case "":
+			case signed:
+				timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+				req.Header.Set("Source-Type", "game")
+				req.Header.Set(TimestampHeader, timestamp)
+				req.Header.Set(NonceHeader, test.name)
+				req.Header.Set(SignatureHeader, Sign("secret", req, []byte("{")))
+			default:
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/controller"
+	"github.com/myrachanto/entaingo/src/api/repository"
+)
+
+// headers of a signed request
+const (
+	SignatureHeader = "X-Signature" // hex HMAC-SHA256 of the canonical request, see canonicalRequest
+	TimestampHeader = "X-Timestamp" // unix seconds the request was signed at
+	NonceHeader     = "X-Nonce"     // unique per request of a provider
+)
+
+// maxNonceLength caps a nonce to the width of its column
+const maxNonceLength = 128
+
+// maxSignedBody caps the body read to check a signature, the largest batch fits well within it
+const maxSignedBody = 4 << 20
+
+// error codes of rejected signatures, and of the failures the API reports the same way everywhere
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeInternal         = "internal_error"
+	codeInvalidSignature = "invalid_signature"
+	codeStaleRequest     = "stale_request"
+	codeReplayedRequest  = "replayed_request"
+)
+
+// SecretStore holds the shared secrets providers sign requests with
+type SecretStore interface {
+	// Secrets returns the active secrets of provider, the current one first.
+	// During a rotation the previous secret stays active next to the new one.
+	Secrets(provider string) ([]string, error)
+}
+
+// envSecrets reads each provider's secrets from SIGNING_SECRETS_<PROVIDER>,
+// a comma separated list of at most two secrets
+type envSecrets struct{}
+
+// NewEnvSecrets reads the signing secrets from the environment
+func NewEnvSecrets() SecretStore {
+	return envSecrets{}
+}
+
+func (envSecrets) Secrets(provider string) ([]string, error) {
+	var secrets []string
+	for _, secret := range strings.Split(os.Getenv("SIGNING_SECRETS_"+strings.ToUpper(provider)), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" && len(secrets) < 2 {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets, nil
+}
+
+// Sign is the signature a provider sends for req with body, its X-Timestamp and X-Nonce headers already set
+func Sign(secret string, req *http.Request, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(canonicalRequest(req, body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalRequest is what a signature covers, one field per line:
+//
+//	<method>\n<path>\n<raw query>\n<User-Id>\n<Source-Type>\n<X-Timestamp>\n<X-Nonce>\n<body>
+//
+// The path is as sent, e.g. /api/v1/transactions/batch, the query without its "?" and empty without one,
+// and a header that isn't sent is an empty line. Covering the account, the provider and the endpoint
+// keeps a captured body and signature from being replayed against another of them.
+func canonicalRequest(req *http.Request, body []byte) []byte {
+	var b bytes.Buffer
+	for _, field := range []string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		req.Header.Get("User-Id"),
+		req.Header.Get("Source-Type"),
+		req.Header.Get(TimestampHeader),
+		req.Header.Get(NonceHeader),
+	} {
+		b.WriteString(field)
+		b.WriteByte('\n')
+	}
+	b.Write(body)
+	return b.Bytes()
+}
+
+// Signed rejects requests that aren't signed with an active secret of the provider named
+// in Source-Type, were signed more than window away from now, or reuse a nonce.
+// Nonces are remembered for twice the window, long enough to outlive any request they could replay.
+func Signed(secrets SecretStore, nonces repository.NonceStore, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider := c.GetHeader("Source-Type")
+		timestamp := c.GetHeader(TimestampHeader)
+		nonce := c.GetHeader(NonceHeader)
+		signature := c.GetHeader(SignatureHeader)
+		if provider == "" || timestamp == "" || nonce == "" || len(nonce) > maxNonceLength || signature == "" {
+			rejectSignature(c, http.StatusUnauthorized, "missing or malformed signature headers", codeInvalidSignature)
+			return
+		}
+		signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			rejectSignature(c, http.StatusUnauthorized, "invalid timestamp", codeInvalidSignature)
+			return
+		}
+		if math.Abs(float64(time.Now().Unix()-signedAt)) > window.Seconds() {
+			rejectSignature(c, http.StatusUnauthorized, "request timestamp is outside the replay window", codeStaleRequest)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSignedBody+1))
+		if err != nil {
+			rejectSignature(c, http.StatusBadRequest, "failed to read the request body", codeInvalidRequest)
+			return
+		}
+		if len(body) > maxSignedBody {
+			rejectSignature(c, http.StatusRequestEntityTooLarge, "request body too large", codeInvalidRequest)
+			return
+		}
+		// the handler reads the body again
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		active, err := secrets.Secrets(provider)
+		if err != nil {
+			unavailable(c, err)
+			return
+		}
+		if !validSignature(active, c.Request, body, signature) {
+			rejectSignature(c, http.StatusUnauthorized, "invalid signature", codeInvalidSignature)
+			return
+		}
+
+		// nonces are only recorded for valid signatures, so forged requests can't use them up
+		fresh, err := nonces.Remember(c.Request.Context(), provider, nonce, 2*window)
+		if err != nil {
+			unavailable(c, err)
+			return
+		}
+		if !fresh {
+			rejectSignature(c, http.StatusUnauthorized, "nonce already used", codeReplayedRequest)
+			return
+		}
+		c.Set(controller.SignedProviderKey, provider)
+		c.Next()
+	}
+}
+
+// validSignature reports whether signature matches req signed with any of the active secrets
+func validSignature(secrets []string, req *http.Request, body []byte, signature string) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	valid := false
+	for _, secret := range secrets {
+		want, _ := hex.DecodeString(Sign(secret, req, body))
+		// every secret is compared, so timing doesn't reveal which one matched
+		if hmac.Equal(got, want) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func rejectSignature(c *gin.Context, status int, message, code string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": message, "code": code})
+}
+
+// unavailable rejects a request whose signature couldn't be checked
+func unavailable(c *gin.Context, err error) {
+	log.Println("signature check failed: ", err)
+	if domainErr := repository.AsError(err); domainErr != nil && domainErr.Kind == repository.KindUnavailable {
+		rejectSignature(c, http.StatusServiceUnavailable, domainErr.Error(), domainErr.Code)
+		return
+	}
+	rejectSignature(c, http.StatusInternalServerError, "failed to check the signature", codeInternal)
+}
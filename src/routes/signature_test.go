@@ -0,0 +1,157 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myrachanto/entaingo/src/api/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticSecrets serves fixed secrets per provider
+type staticSecrets map[string][]string
+
+func (s staticSecrets) Secrets(provider string) ([]string, error) {
+	return s[provider], nil
+}
+
+// failingNonces is a nonce store whose database is down
+type failingNonces struct{}
+
+func (failingNonces) Remember(ctx context.Context, provider, nonce string, ttl time.Duration) (bool, error) {
+	return false, repository.ErrUnavailable
+}
+
+func TestSigned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	secrets := staticSecrets{"game": {"new-secret", "old-secret"}, "server": {"server-secret"}}
+	body := `{"state": "win", "amount": 10, "currency": "USD", "transactionId": "tx1", "userId": 1}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name           string
+		source         string
+		timestamp      string
+		nonce          string
+		secret         string
+		signature      string // overrides the computed signature when set
+		nonces         repository.NonceStore
+		tamper         func(req *http.Request) // changes the request after it was signed
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"signed with the current secret", "game", now, "n-1", "new-secret", "", nil, nil, http.StatusOK, ""},
+		{"signed with the previous secret", "game", now, "n-2", "old-secret", "", nil, nil, http.StatusOK, ""},
+		{"signed with a retired secret", "game", now, "n-3", "older-secret", "", nil, nil, http.StatusUnauthorized, codeInvalidSignature},
+		{"signed with another provider's secret", "game", now, "n-4", "server-secret", "", nil, nil, http.StatusUnauthorized, codeInvalidSignature},
+		{"provider without secrets", "payment", now, "n-5", "new-secret", "", nil, nil, http.StatusUnauthorized, codeInvalidSignature},
+		{"unsigned", "game", now, "n-6", "", "-", nil, nil, http.StatusUnauthorized, codeInvalidSignature},
+		{"signature not hex", "game", now, "n-7", "", "zz", nil, nil, http.StatusUnauthorized, codeInvalidSignature},
+		{"missing nonce", "game", now, "", "new-secret", "", nil, nil, http.StatusUnauthorized, codeInvalidSignature},
+		{"invalid timestamp", "game", "yesterday", "n-8", "new-secret", "", nil, nil, http.StatusUnauthorized, codeInvalidSignature},
+		{"outside the replay window", "game", stale, "n-9", "new-secret", "", nil, nil, http.StatusUnauthorized, codeStaleRequest},
+		{"nonce store down", "game", now, "n-10", "new-secret", "", failingNonces{}, nil, http.StatusServiceUnavailable, "unavailable"},
+		{"another account", "game", now, "n-11", "new-secret", "", nil, func(req *http.Request) { req.Header.Set("User-Id", "2") }, http.StatusUnauthorized, codeInvalidSignature},
+		{"another provider", "game", now, "n-12", "new-secret", "", nil, func(req *http.Request) { req.Header.Set("Source-Type", "server") }, http.StatusUnauthorized, codeInvalidSignature},
+		{"another endpoint", "game", now, "n-13", "new-secret", "", nil, func(req *http.Request) { req.URL.Path = "/transactions/batch" }, http.StatusUnauthorized, codeInvalidSignature},
+		{"another query", "game", now, "n-14", "new-secret", "", nil, func(req *http.Request) { req.URL.RawQuery = "mode=atomic" }, http.StatusUnauthorized, codeInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonces := tt.nonces
+			if nonces == nil {
+				nonces = repository.NewMemoryNonces()
+			}
+			var received string
+			router := gin.New()
+			handler := func(c *gin.Context) {
+				data, _ := c.GetRawData()
+				received = string(data)
+				c.Status(http.StatusOK)
+			}
+			router.POST("/transaction", Signed(secrets, nonces, 5*time.Minute), handler)
+			router.POST("/transactions/batch", Signed(secrets, nonces, 5*time.Minute), handler)
+
+			req, _ := http.NewRequest(http.MethodPost, "/transaction", bytes.NewBufferString(body))
+			req.Header.Set("Source-Type", tt.source)
+			req.Header.Set("User-Id", "1")
+			req.Header.Set(TimestampHeader, tt.timestamp)
+			req.Header.Set(NonceHeader, tt.nonce)
+			signature := tt.signature
+			if signature == "" {
+				signature = Sign(tt.secret, req, []byte(body))
+			} else if signature == "-" {
+				signature = ""
+			}
+			req.Header.Set(SignatureHeader, signature)
+			if tt.tamper != nil {
+				tt.tamper(req)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusOK {
+				assert.Equal(t, body, received, "the handler reads the signed body")
+			} else {
+				assert.Contains(t, w.Body.String(), `"code":"`+tt.expectedCode+`"`)
+			}
+		})
+	}
+}
+
+func TestCanonicalRequest(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/transactions/batch?mode=atomic", nil)
+	req.Header.Set("User-Id", "7")
+	req.Header.Set("Source-Type", "game")
+	req.Header.Set(TimestampHeader, "1729598400")
+	req.Header.Set(NonceHeader, "n-1")
+	assert.Equal(t, "POST\n/api/v1/transactions/batch\nmode=atomic\n7\ngame\n1729598400\nn-1\n[]", string(canonicalRequest(req, []byte("[]"))))
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/v1/transactions/external/tx1", nil)
+	req.Header.Set("Source-Type", "game")
+	assert.Equal(t, "GET\n/api/v1/transactions/external/tx1\n\n\ngame\n\n\n", string(canonicalRequest(req, nil)), "headers not sent are empty lines")
+}
+
+func TestSignedRejectsReplays(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	secrets := staticSecrets{"game": {"secret"}}
+	router := gin.New()
+	router.POST("/transaction", Signed(secrets, repository.NewMemoryNonces(), 5*time.Minute), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	send := func(nonce string, body string) int {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req, _ := http.NewRequest(http.MethodPost, "/transaction", bytes.NewBufferString(body))
+		req.Header.Set("Source-Type", "game")
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(NonceHeader, nonce)
+		req.Header.Set(SignatureHeader, Sign("secret", req, []byte(body)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("n-1", `{"a":1}`))
+	assert.Equal(t, http.StatusUnauthorized, send("n-1", `{"a":1}`), "a replayed request is rejected")
+	assert.Equal(t, http.StatusUnauthorized, send("n-1", `{"a":2}`), "a reused nonce is rejected whatever the body")
+	assert.Equal(t, http.StatusOK, send("n-2", `{"a":1}`), "a new nonce is accepted")
+}
+
+func TestEnvSecrets(t *testing.T) {
+	t.Setenv("SIGNING_SECRETS_GAME", " new , old , older ")
+	secrets, err := NewEnvSecrets().Secrets("game")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new", "old"}, secrets, "at most two secrets are active")
+
+	secrets, _ = NewEnvSecrets().Secrets("payment")
+	assert.Empty(t, secrets)
+}